@@ -1,20 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/LF-Engineering/dev-analytics-libraries/auth0"
@@ -22,9 +35,10 @@ import (
 	dahttp "github.com/LF-Engineering/dev-analytics-libraries/http"
 	"github.com/LF-Engineering/dev-analytics-libraries/slack"
 	"github.com/LF-Engineering/dev-analytics-libraries/uuid"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/mattn/go-sqlite3"
 )
 
 var (
@@ -32,8 +46,32 @@ var (
 	gSQLQuiet    = false
 	gDebug       = false
 	gDry         = false
-	gToken       = ""
-	gTokenMtx    = &sync.Mutex{}
+	gTxIsolation = sql.LevelDefault
+	gDialect     = dialect(mysqlDialect{})
+	gReadDB      *sqlx.DB
+	gSlowQuery   = 5 * time.Second
+	gDBRetryMax  = 5
+	gDBRetries   = map[string]int{}
+	gDBRetryMtx  = &sync.Mutex{}
+	gSQLRedact   = "emails"
+	gSQLLogJSON  = jsoniter.Config{EscapeHTML: false}.Froze()
+	gTxSeq       int64
+	gTxIDs       = &sync.Map{}
+	gStop        = make(chan struct{})
+	gUnprocessed []string
+	gUnprocMtx   = &sync.Mutex{}
+	// errStopped - returned by page processing when the run is being stopped
+	// errTripped - returned for changes refused by the tripped circuit breaker, so checkpoints never skip them
+	errStopped  = errors.New("run stopped")
+	errTripped  = errors.New("circuit breaker tripped")
+	gRunID      = ""
+	gOperator   = ""
+	gScope      scope
+	gBackupFile *os.File
+	gBackupMtx  = &sync.Mutex{}
+	// gTxBackups - before-images saved in open transactions, written to the backup file when they commit
+	gTxBackups   = &sync.Map{}
+	gPlan        *planWriter
 	gAuth0Client *auth0.ClientProvider
 	gTokenEnv    string
 	// MT - multithreading?
@@ -48,12 +86,90 @@ var (
 	emailsCacheMtx    *sync.RWMutex
 	uuidsAffsCache    = map[string]string{}
 	uuidsAffsCacheMtx *sync.RWMutex
+	gQuarantine       []quarantineItem
+	gQuarantineMtx    = &sync.Mutex{}
 )
 
+// backupRecord - full before-image of a row modified or deleted by the cleanup
+// NewKey is set when the row's key was changed by the update
+type backupRecord struct {
+	RunID  string                 `json:"run_id"`
+	Time   time.Time              `json:"time"`
+	Op     string                 `json:"op"`
+	Table  string                 `json:"table"`
+	KeyCol string                 `json:"key_col"`
+	Key    string                 `json:"key"`
+	NewKey string                 `json:"new_key,omitempty"`
+	Row    map[string]interface{} `json:"row"`
+}
+
+// profileIdentity - identity with missing name processed by profiles cleanup
+type profileIdentity struct {
+	id       string
+	uuid     *string
+	source   string
+	name     *string
+	username *string
+	email    *string
+}
+
+// emailIdentity - identity with non-empty email processed by emails cleanup
+type emailIdentity struct {
+	id       string
+	uuid     string
+	source   string
+	name     string
+	username string
+	email    string
+}
+
+// emailProfile - profile with non-empty email processed by emails cleanup
+type emailProfile struct {
+	uuid  string
+	email string
+}
+
+// identityChange - identity email (and ID) rewrite computed by emails cleanup
+type identityChange struct {
+	i         int
+	valid     bool
+	mismatch  bool
+	id        string
+	uuid      string
+	uidentity string
+	source    string
+	name      string
+	username  string
+	currEmail string
+	email     string
+}
+
+// profileChange - profile email rewrite computed by emails cleanup
+type profileChange struct {
+	i         int
+	valid     bool
+	uuid      string
+	currEmail string
+	email     string
+}
+
+// quarantineItem - input tuple of a row skipped because it needs manual fixing
+type quarantineItem struct {
+	Table    string `json:"table"`
+	ID       string `json:"id"`
+	Source   string `json:"source"`
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	NewEmail string `json:"new_email"`
+	Reason   string `json:"reason"`
+}
+
 // uuidAffs - generate UUID of string args
 // uses internal cache
 // downcases arguments, all but first can be empty
-func uuidAffs(args ...string) (h string) {
+// returns error when UUID cannot be generated
+func uuidAffs(args ...string) (h string, err error) {
 	k := strings.Join(args, ":")
 	if MT {
 		uuidsAffsCacheMtx.RLock()
@@ -63,6 +179,9 @@ func uuidAffs(args ...string) (h string) {
 		uuidsAffsCacheMtx.RUnlock()
 	}
 	if ok {
+		if h == "" {
+			err = fmt.Errorf("uuidAffs error for: %+v (cached)", args)
+		}
 		return
 	}
 	defer func() {
@@ -74,19 +193,72 @@ func uuidAffs(args ...string) (h string) {
 			uuidsAffsCacheMtx.Unlock()
 		}
 	}()
-	var err error
 	if len(args) != 4 {
 		err = fmt.Errorf("GenerateIdentity requires exactly 4 asrguments, got %+v", args)
 	} else {
 		h, err = uuid.GenerateIdentity(&args[0], &args[1], &args[2], &args[3])
+		if err == nil && h == "" {
+			err = fmt.Errorf("GenerateIdentity returned empty UUID")
+		}
 	}
 	if err != nil {
-		fmt.Printf("uuidAffs error for: %+v\n", args)
+		err = fmt.Errorf("uuidAffs error for: %+v: %+v", args, err)
 		h = ""
 	}
 	return
 }
 
+// quarantine - add row that cannot be processed automatically to the quarantine report
+func quarantine(item quarantineItem) {
+	gQuarantineMtx.Lock()
+	gQuarantine = append(gQuarantine, item)
+	gQuarantineMtx.Unlock()
+}
+
+// writeQuarantine - save quarantine report (one JSON object per line) for manual fixing
+// file name is taken from QUARANTINE_FILE, defaults to quarantine.json
+func writeQuarantine() (err error) {
+	gQuarantineMtx.Lock()
+	defer gQuarantineMtx.Unlock()
+	if len(gQuarantine) == 0 {
+		return
+	}
+	fn := os.Getenv("QUARANTINE_FILE")
+	if fn == "" {
+		fn = "quarantine.json"
+	}
+	data := []byte{}
+	for _, item := range gQuarantine {
+		var line []byte
+		line, err = jsoniter.Marshal(item)
+		if err != nil {
+			return
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	// resumed run adds to the quarantine report of its earlier part
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if gResumed {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(fn, flags, 0644)
+	if err != nil {
+		return
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return
+	}
+	err = file.Close()
+	if err != nil {
+		return
+	}
+	fmt.Printf("%d rows quarantined, saved to %s\n", len(gQuarantine), fn)
+	return
+}
+
 // isValidDomain - is MX domain valid?
 // uses internal cache
 func isValidDomain(domain string) (valid bool) {
@@ -185,788 +357,5184 @@ func isValidEmail(email string, validateDomain, guess bool) (valid bool, newEmai
 }
 
 func initAffsDB() *sqlx.DB {
-	dbURL := os.Getenv("DB_ENDPOINT")
-	if !strings.Contains(dbURL, "parseTime=true") {
-		if strings.Contains(dbURL, "?") {
-			dbURL += "&parseTime=true"
-		} else {
-			dbURL += "?parseTime=true"
-		}
-	}
-	d, err := sqlx.Connect("mysql", dbURL)
+	gDialect = getDialect()
+	dbURL := gDialect.dsn(os.Getenv("DB_ENDPOINT"))
+	d, err := sqlx.Connect(gDialect.driver(), dbURL)
 	if err != nil {
 		log.Panicf("unable to connect to affiliation database: %v", err)
 	}
+	readEndpoint := os.Getenv("DB_READ_ENDPOINT")
+	if readEndpoint != "" {
+		gReadDB, err = sqlx.Connect(gDialect.driver(), gDialect.dsn(readEndpoint))
+		if err != nil {
+			log.Panicf("unable to connect to affiliation database read endpoint: %v", err)
+		}
+		fmt.Printf("using read endpoint for scans and prechecks\n")
+	}
 	gSQLOut = os.Getenv("SQLDEBUG") != ""
 	gDebug = os.Getenv("DEBUG") != ""
-	gDry = os.Getenv("DRY") != ""
+	gDry = os.Getenv("DRY") != "" || os.Getenv("PLAN") != ""
+	gTxIsolation = getTxIsolation()
+	gSlowQuery = getSlowQuery()
+	gDBRetryMax = getDBRetries()
+	gSQLRedact = strings.ToLower(os.Getenv("SQL_REDACT"))
 	return d
 }
 
-// queryOut - display DB query
-func queryOut(query string, args ...interface{}) {
-	if gDry {
-		query = "dry-run: " + query
-	}
-	log.Println(query)
-	str := ""
-	if len(args) > 0 {
-		for vi, vv := range args {
-			switch v := vv.(type) {
-			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, complex64, complex128, string, bool, time.Time:
-				str += fmt.Sprintf("%d:%+v ", vi+1, v)
-			case *int, *int8, *int16, *int32, *int64, *uint, *uint8, *uint16, *uint32, *uint64, *float32, *float64, *complex64, *complex128, *string, *bool, *time.Time:
-				str += fmt.Sprintf("%d:%+v ", vi+1, v)
-			case nil:
-				str += fmt.Sprintf("%d:(null) ", vi+1)
-			default:
-				str += fmt.Sprintf("%d:%+v ", vi+1, reflect.ValueOf(vv))
-			}
-		}
-		log.Println("[" + str + "]")
-	}
-	fmt.Printf("%s\n", query)
-	if str != "" {
-		fmt.Printf("[%s]\n", str)
+// readDB - database used for bulk scans and read-only prechecks: DB_READ_ENDPOINT replica if set, db otherwise
+// data read from it can lag behind the primary, so it is re-read on db before being modified
+func readDB(db *sqlx.DB) *sqlx.DB {
+	if gReadDB != nil {
+		return gReadDB
 	}
+	return db
 }
 
-// queryDB - query database without transaction
-func queryDB(db *sqlx.DB, query string, quiet bool, args ...interface{}) (rows *sql.Rows, err error) {
-	rows, err = db.Query(query, args...)
-	if !gSQLQuiet && !quiet && (err != nil || gSQLOut) {
-		if err != nil {
-			log.Println("queryDB failed")
-		}
-		queryOut(query, args...)
-	}
-	return
+// dialect - database specific parts of the query layer
+type dialect interface {
+	// driver - database/sql driver name
+	driver() string
+	// dsn - connection string for a given DB_ENDPOINT
+	dsn(endpoint string) string
+	// rebind - convert '?' placeholders to the ones used by the database
+	rebind(query string) string
+	// isDuplicateKey - is error caused by unique key violation?
+	isDuplicateKey(err error) bool
+	// retryReason - non-empty reason when error is a transient lock conflict and the transaction can be retried
+	retryReason(err error) string
+	// upsert - insert or update row by key column, values are bound to columns in order
+	upsert(table, keyCol string, columns []string) string
+	// forUpdate - suffix of a select locking the rows it reads until the end of the transaction
+	forUpdate() string
+	// schemaQueries - queries returning (table, column), (table, index, column) for unique keys ordered by index
+	// position and (table, column, referenced table, referenced column) for tables listed in 'in' placeholders
+	schemaQueries(in string) (columns, uniques, fks string)
 }
 
-// queryTX - query database with transaction
-func queryTX(db *sql.Tx, query string, quiet bool, args ...interface{}) (rows *sql.Rows, err error) {
-	rows, err = db.Query(query, args...)
-	if !gSQLQuiet && !quiet && (err != nil || gSQLOut) {
-		if err != nil {
-			log.Println("queryTX failed")
+// mysqlDialect - MySQL, used by the affiliation database
+type mysqlDialect struct{}
+
+// sqliteDialect - SQLite, for local and offline runs on a database copy
+type sqliteDialect struct{}
+
+func (mysqlDialect) driver() string { return "mysql" }
+
+func (mysqlDialect) dsn(endpoint string) string {
+	if !strings.Contains(endpoint, "parseTime=true") {
+		if strings.Contains(endpoint, "?") {
+			endpoint += "&parseTime=true"
+		} else {
+			endpoint += "?parseTime=true"
 		}
-		queryOut(query, args...)
 	}
-	return
+	return endpoint
 }
 
-// query - query DB using transaction if provided
-func query(db *sqlx.DB, tx *sql.Tx, query string, args ...interface{}) (*sql.Rows, error) {
-	if tx == nil {
-		return queryDB(db, query, false, args...)
+func (mysqlDialect) rebind(query string) string { return sqlx.Rebind(sqlx.BindType("mysql"), query) }
+
+func (mysqlDialect) isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062
 	}
-	return queryTX(tx, query, false, args...)
+	return err != nil && strings.Contains(err.Error(), "Duplicate entry")
 }
 
-// execDB - execute DB query without transaction
-func execDB(db *sqlx.DB, query string, quiet bool, args ...interface{}) (res sql.Result, err error) {
-	res, err = db.Exec(query, args...)
-	if !gSQLQuiet && !quiet && (err != nil || gSQLOut) {
-		if err != nil {
-			log.Println("execDB failed")
+func (mysqlDialect) retryReason(err error) string {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1213:
+			return "deadlock"
+		case 1205:
+			return "lock wait timeout"
 		}
-		queryOut(query, args...)
 	}
-	return
+	return ""
 }
 
-// execTX - execute DB query with transaction
-func execTX(db *sql.Tx, query string, quiet bool, args ...interface{}) (res sql.Result, err error) {
-	res, err = db.Exec(query, args...)
-	if !gSQLQuiet && !quiet && (err != nil || gSQLOut) {
-		if err != nil {
-			log.Println("execTX failed")
-		}
-		queryOut(query, args...)
+func (mysqlDialect) upsert(table, keyCol string, columns []string) string {
+	updates := []string{}
+	for _, column := range columns {
+		updates = append(updates, column+" = values("+column+")")
 	}
+	return "insert into " + table + "(" + strings.Join(columns, ", ") + ") values(?" + strings.Repeat(",?", len(columns)-1) + ") " +
+		"on duplicate key update " + strings.Join(updates, ", ")
+}
+
+func (mysqlDialect) forUpdate() string { return " for update" }
+
+func (mysqlDialect) schemaQueries(in string) (columns, uniques, fks string) {
+	columns = "select table_name, column_name from information_schema.columns where table_schema = database() and table_name in " + in
+	uniques = "select table_name, index_name, column_name from information_schema.statistics where table_schema = database() " +
+		"and non_unique = 0 and table_name in " + in + " order by table_name, index_name, seq_in_index"
+	fks = "select table_name, column_name, referenced_table_name, referenced_column_name from information_schema.key_column_usage " +
+		"where table_schema = database() and referenced_table_name is not null and table_name in " + in
 	return
 }
 
-// exec - execute db query with transaction if provided
-func exec(db *sqlx.DB, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
-	if gDry {
-		if gDebug || gSQLOut {
-			queryOut(query, args...)
-		}
-		return nil, nil
+func (sqliteDialect) driver() string { return "sqlite3" }
+
+// dsn - DB_ENDPOINT is a database file name (optionally prefixed with sqlite://),
+// foreign keys are enforced and writers wait for locks like they do in MySQL
+func (sqliteDialect) dsn(endpoint string) string {
+	endpoint = strings.TrimPrefix(endpoint, "sqlite://")
+	params := []string{}
+	if !strings.Contains(endpoint, "_foreign_keys=") && !strings.Contains(endpoint, "_fk=") {
+		params = append(params, "_foreign_keys=1")
 	}
-	if tx == nil {
-		return execDB(db, query, false, args...)
+	if !strings.Contains(endpoint, "_busy_timeout=") && !strings.Contains(endpoint, "_timeout=") {
+		params = append(params, "_busy_timeout=60000")
+	}
+	if len(params) == 0 {
+		return endpoint
 	}
-	return execTX(tx, query, false, args...)
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + strings.Join(params, "&")
+	}
+	return endpoint + "?" + strings.Join(params, "&")
 }
 
-// execQuiet - execute db query with transaction if provided
-func execQuiet(db *sqlx.DB, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
-	if gDry {
-		if gDebug || gSQLOut {
-			queryOut(query, args...)
-		}
-		return nil, nil
-	}
-	if tx == nil {
-		return execDB(db, query, true, args...)
+func (sqliteDialect) rebind(query string) string { return sqlx.Rebind(sqlx.BindType("sqlite3"), query) }
+
+func (sqliteDialect) isDuplicateKey(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
 	}
-	return execTX(tx, query, true, args...)
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
 }
 
-func getThreadsNum() (thrN int) {
-	defer func() {
-		MT = thrN > 1
-		if MT {
-			emailsCacheMtx = &sync.RWMutex{}
-			uuidsAffsCacheMtx = &sync.RWMutex{}
-		}
-	}()
-	nCPUsStr := os.Getenv("N_CPUS")
-	nCPUs := 0
-	if nCPUsStr != "" {
-		var err error
-		nCPUs, err = strconv.Atoi(nCPUsStr)
-		if err != nil || nCPUs < 0 {
-			nCPUs = 0
+func (sqliteDialect) retryReason(err error) string {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy:
+			return "database busy"
+		case sqlite3.ErrLocked:
+			return "database locked"
 		}
 	}
-	if nCPUs > 0 {
-		n := runtime.NumCPU()
-		if nCPUs > n {
-			nCPUs = n
-		}
-		runtime.GOMAXPROCS(nCPUs)
-		thrN = nCPUs
-		return
+	return ""
+}
+
+func (sqliteDialect) upsert(table, keyCol string, columns []string) string {
+	updates := []string{}
+	for _, column := range columns {
+		updates = append(updates, column+" = excluded."+column)
 	}
-	thrN = runtime.NumCPU()
-	runtime.GOMAXPROCS(thrN)
+	return "insert into " + table + "(" + strings.Join(columns, ", ") + ") values(?" + strings.Repeat(",?", len(columns)-1) + ") " +
+		"on conflict(" + keyCol + ") do update set " + strings.Join(updates, ", ")
+}
+
+// SQLite has no row locks, a concurrent writer cannot commit while a transaction holds its read lock,
+// such conflicts are reported as busy database and retried
+func (sqliteDialect) forUpdate() string { return "" }
+
+func (sqliteDialect) schemaQueries(in string) (columns, uniques, fks string) {
+	columns = "select m.name, p.name from sqlite_master m join pragma_table_info(m.name) p where m.type = 'table' and m.name in " + in
+	// integer primary keys are rowid aliases without an index, so primary keys are listed from table info
+	uniques = "with m as (select name from sqlite_master where type = 'table' and name in " + in + ") " +
+		"select t, i, c from (select m.name t, il.name i, ii.name c, ii.seqno s from m join pragma_index_list(m.name) il " +
+		"join pragma_index_info(il.name) ii where il.\"unique\" = 1 " +
+		"union all select m.name, 'primary', p.name, p.pk from m join pragma_table_info(m.name) p where p.pk > 0) order by t, i, s"
+	fks = "select m.name, f.\"from\", f.\"table\", f.\"to\" from sqlite_master m join pragma_foreign_key_list(m.name) f " +
+		"where m.type = 'table' and m.name in " + in
 	return
 }
 
-func initializeAuth0() error {
-	var err error
-	auth0DataB64 := os.Getenv("AUTH0_DATA")
-	if auth0DataB64 == "" {
-		return fmt.Errorf("you must specify AUTH0_DATA (so the program can generate an API token) or specify token with JWT_TOKEN")
+// getDialect - database dialect from DB_DIALECT: mysql (default) or sqlite
+func getDialect() dialect {
+	switch strings.ToLower(os.Getenv("DB_DIALECT")) {
+	case "", "mysql":
+		return mysqlDialect{}
+	case "sqlite", "sqlite3":
+		return sqliteDialect{}
 	}
-	var auth0Data []byte
-	auth0Data, err = base64.StdEncoding.DecodeString(auth0DataB64)
-	if err != nil {
-		fmt.Printf("decode base64 error: %+v\n", err)
-		return err
+	log.Panicf("unknown database dialect: '%s'", os.Getenv("DB_DIALECT"))
+	return nil
+}
+
+// getTxIsolation - parse TX_ISOLATION, for example: read-committed, REPEATABLE READ, serializable
+// returns driver's default isolation level when not set
+func getTxIsolation() sql.IsolationLevel {
+	isolation := os.Getenv("TX_ISOLATION")
+	if isolation == "" {
+		return sql.LevelDefault
 	}
-	var data map[string]string
-	err = jsoniter.Unmarshal([]byte(auth0Data), &data)
-	if err != nil {
-		fmt.Printf("unmarshal error: %+v\n", err)
-		return err
+	isolation = strings.ToLower(strings.TrimSpace(strings.NewReplacer("-", " ", "_", " ").Replace(isolation)))
+	for _, level := range []sql.IsolationLevel{
+		sql.LevelReadUncommitted,
+		sql.LevelReadCommitted,
+		sql.LevelWriteCommitted,
+		sql.LevelRepeatableRead,
+		sql.LevelSnapshot,
+		sql.LevelSerializable,
+		sql.LevelLinearizable,
+	} {
+		if strings.ToLower(level.String()) == isolation {
+			return level
+		}
 	}
-	// Providers
-	httpClientProvider := dahttp.NewClientProvider(60 * time.Second)
-	esCacheClientProvider, err := elastic.NewClientProvider(
-		&elastic.Params{
-			URL:      data["es_url"],
-			Username: data["es_user"],
-			Password: data["es_pass"],
-		})
-	if err != nil {
-		fmt.Printf("ES client provider error: %+v\n", err)
-		return err
+	log.Panicf("unknown transaction isolation level: '%s'", os.Getenv("TX_ISOLATION"))
+	return sql.LevelDefault
+}
+
+// beginTX - start a new transaction using configured isolation level
+// returns nil transaction in dry-run mode
+func beginTX(ctx context.Context, db *sqlx.DB) (tx *sql.Tx, err error) {
+	if gDry {
+		return
 	}
-	slackProvider := slack.New(data["slack_webhook_url"])
-	gAuth0Client, err = auth0.NewAuth0Client(
-		data["env"],
-		data["grant_type"],
-		data["client_id"],
-		data["client_secret"],
-		data["audience"],
-		data["url"],
-		httpClientProvider,
-		esCacheClientProvider,
-		&slackProvider,
-		"identity-profile-cleanup",
-	)
+	start := time.Now()
+	tx, err = db.BeginTx(ctx, &sql.TxOptions{Isolation: gTxIsolation})
 	if err == nil {
-		gTokenEnv = data["env"]
+		gTxIDs.Store(tx, atomic.AddInt64(&gTxSeq, 1))
 	}
-	return err
+	sqlOut("begin", tx, "", false, start, nil, err)
+	return
 }
 
-func getAPIToken() (string, error) {
-	envToken := os.Getenv("JWT_TOKEN")
-	if envToken != "" {
-		return envToken, nil
+// commitTX - commit transaction if provided
+func commitTX(tx *sql.Tx) (err error) {
+	if tx == nil {
+		return
 	}
-	if gTokenEnv == "" {
-		err := initializeAuth0()
+	start := time.Now()
+	err = tx.Commit()
+	sqlOut("commit", tx, "", false, start, nil, err)
+	gTxIDs.Delete(tx)
+	pending, ok := gTxBackups.LoadAndDelete(tx)
+	if ok && err == nil {
+		data, _ := pending.([]byte)
+		err = writeBackup(data)
 		if err != nil {
-			return "", err
+			err = fmt.Errorf("changes committed, but their backup was not saved: %w", err)
 		}
 	}
-	token, err := gAuth0Client.GetToken()
-	if err == nil && token != "" {
-		token = "Bearer " + token
-	}
-	return token, err
+	return
 }
 
-func executeAffiliationsAPICall(apiPath, path string) (err error) {
-	if gDry {
-		if gDebug {
-			fmt.Printf("dry-run API call: '%s'\n", path)
-		}
+// rollbackTX - rollback transaction if provided
+func rollbackTX(tx *sql.Tx) {
+	if tx == nil {
 		return
 	}
-	if apiPath == "" {
-		err = fmt.Errorf("Cannot execute DA affiliation API calls, no API URL specified")
-		return
+	start := time.Now()
+	err := tx.Rollback()
+	sqlOut("rollback", tx, "", false, start, nil, err)
+	gTxIDs.Delete(tx)
+	gTxBackups.Delete(tx)
+}
+
+// isDuplicateKeyError - is error caused by unique key violation?
+func isDuplicateKeyError(err error) bool {
+	return err == errDryRunDuplicate || gDialect.isDuplicateKey(err)
+}
+
+// getRunID - unique ID of the current run, can be set via RUN_ID
+func getRunID() string {
+	runID := os.Getenv("RUN_ID")
+	if runID == "" {
+		runID = os.Getenv("RESUME")
 	}
-	gTokenMtx.Lock()
-	if gToken == "" {
-		gToken = os.Getenv("JWT_TOKEN")
+	if runID == "" {
+		runID = time.Now().UTC().Format("20060102150405") + "-" + strconv.Itoa(os.Getpid())
 	}
-	if gToken == "" {
-		fmt.Printf("obtaining API token\n")
-		gToken, err = getAPIToken()
-		if err != nil {
-			gTokenMtx.Unlock()
-			fmt.Printf("get API token error: %+v\n", err)
-			os.Exit(1)
-			return
-		}
+	return runID
+}
+
+// backupFileName - backup file of a given run: BACKUP_DIR/<run-id>.json (default BACKUP_DIR is backups)
+func backupFileName(runID string) string {
+	dir := os.Getenv("BACKUP_DIR")
+	if dir == "" {
+		dir = "backups"
 	}
-	gTokenMtx.Unlock()
-	method := http.MethodPut
-	rurl := path
-	url := apiPath + rurl
-	for i := 0; i < 2; i++ {
-		req, e := http.NewRequest(method, url, nil)
-		if e != nil {
-			err = fmt.Errorf("new request error: %+v for %s url: %s", e, method, rurl)
-			return
+	return filepath.Join(dir, runID+".json")
+}
+
+// selectRows - select full rows from a table as column -> value maps
+func selectRows(ctx context.Context, db *sqlx.DB, tx *sql.Tx, table, where string, args ...interface{}) (result []map[string]interface{}, err error) {
+	rows, err := query(ctx, db, tx, "select * from "+table+" where "+where, args...)
+	if err != nil {
+		return
+	}
+	defer func() { _ = rows.Close() }()
+	columns, err := rows.Columns()
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
 		}
-		gTokenMtx.Lock()
-		req.Header.Set("Authorization", gToken)
-		gTokenMtx.Unlock()
-		resp, e := http.DefaultClient.Do(req)
-		if e != nil {
-			err = fmt.Errorf("do request error: %+v for %s url: %s", e, method, rurl)
+		err = rows.Scan(pointers...)
+		if err != nil {
 			return
 		}
-		if i == 0 && resp.StatusCode == 401 {
-			_ = resp.Body.Close()
-			fmt.Printf("token is invalid, trying to generate another one\n")
-			gTokenMtx.Lock()
-			gToken, err = getAPIToken()
-			gTokenMtx.Unlock()
-			if err != nil {
-				fmt.Printf("get API token error: %+v\n", err)
-				os.Exit(1)
-				return
-			}
-			continue
-		}
-		if resp.StatusCode != 200 {
-			body, e := ioutil.ReadAll(resp.Body)
-			_ = resp.Body.Close()
-			if e != nil {
-				err = fmt.Errorf("readAll non-ok request error: %+v for %s url: %s", e, method, rurl)
-				return
+		row := make(map[string]interface{})
+		for i, column := range columns {
+			switch v := values[i].(type) {
+			case []byte:
+				row[column] = string(v)
+			case time.Time:
+				row[column] = v.Format("2006-01-02 15:04:05.999999")
+			default:
+				row[column] = v
 			}
-			err = fmt.Errorf("method:%s url:%s status:%d\n%s", method, rurl, resp.StatusCode, body)
-			return
 		}
-		break
+		result = append(result, row)
 	}
+	err = rows.Err()
 	return
 }
 
-func cleanupProfiles(db *sqlx.DB) (err error) {
-	var (
-		rows      *sql.Rows
-		ids       []string
-		uuids     []*string
-		sources   []string
-		names     []*string
-		usernames []*string
-		emails    []*string
-		id        string
-		uuid      *string
-		source    string
-		name      *string
-		username  *string
-		email     *string
-		mtx       *sync.Mutex
-	)
-	apiPath := os.Getenv("API_URL")
-	if apiPath == "" {
-		err = fmt.Errorf("API_URL must be set")
+// backup - save before-images of rows to the current run's backup file (one JSON object per line)
+// before-images of rows read in transaction tx are kept until it commits, so changes rolled back
+// (possibly to be retried) are not backed up
+func backup(tx *sql.Tx, op, table, keyCol, newKey string, rows []map[string]interface{}) (err error) {
+	if gDry || len(rows) == 0 {
 		return
 	}
-	merges := 0
-	idMap := map[string]string{}
-	uuidMap := map[string]string{}
-	getKey := func(source string, username, email *string) (key string) {
-		key = source
-		if username != nil && *username != "" {
-			key += ":" + *username
-		}
-		if email != nil && *email != "" {
-			key += ":" + *email
+	data := []byte{}
+	now := time.Now()
+	for _, row := range rows {
+		var line []byte
+		line, err = jsoniter.Marshal(
+			backupRecord{
+				RunID:  gRunID,
+				Time:   now,
+				Op:     op,
+				Table:  table,
+				KeyCol: keyCol,
+				Key:    fmt.Sprintf("%v", row[keyCol]),
+				NewKey: newKey,
+				Row:    row,
+			},
+		)
+		if err != nil {
+			return
 		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	if tx != nil {
+		pending, _ := gTxBackups.Load(tx)
+		buffered, _ := pending.([]byte)
+		gTxBackups.Store(tx, append(buffered, data...))
 		return
 	}
-	processIdentity := func(ch chan error, i int) (err error) {
-		defer func() {
-			if ch != nil {
-				ch <- err
-			}
-		}()
-		source := sources[i]
-		username := usernames[i]
-		email := emails[i]
-		key := getKey(source, username, email)
-		uuid2, ok := uuidMap[key]
-		if !ok {
-			return
-		}
-		puuid := uuids[i]
-		if puuid == nil {
+	err = writeBackup(data)
+	return
+}
+
+// writeBackup - append before-image lines to the current run's backup file, opened on first use
+func writeBackup(data []byte) (err error) {
+	if len(data) == 0 {
+		return
+	}
+	gBackupMtx.Lock()
+	defer gBackupMtx.Unlock()
+	if gBackupFile == nil {
+		fn := backupFileName(gRunID)
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
 			return
 		}
-		uuid := *puuid
-		if uuid == uuid2 {
+		gBackupFile, err = os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
 			return
 		}
-		id := ids[i]
-		id2, _ := idMap[key]
+		fmt.Printf("saving backups to %s\n", fn)
+	}
+	_, err = gBackupFile.Write(data)
+	return
+}
+
+// backupRows - select rows from a table and save their before-images
+func backupRows(ctx context.Context, db *sqlx.DB, tx *sql.Tx, op, table, keyCol, newKey, where string, args ...interface{}) (err error) {
+	if gDry {
+		return
+	}
+	rows, err := selectRows(ctx, db, tx, table, where, args...)
+	if err != nil {
+		return
+	}
+	err = backup(tx, op, table, keyCol, newKey, rows)
+	return
+}
+
+// closeBackup - close current run's backup file
+func closeBackup() {
+	gBackupMtx.Lock()
+	defer gBackupMtx.Unlock()
+	if gBackupFile == nil {
+		return
+	}
+	err := gBackupFile.Close()
+	if err != nil {
+		fmt.Printf("close backup file error: %+v\n", err)
+	}
+	gBackupFile = nil
+}
+
+// sqlEvent - structured log event of a single DB operation
+type sqlEvent struct {
+	Time         time.Time     `json:"time"`
+	RunID        string        `json:"run_id,omitempty"`
+	Op           string        `json:"op"`
+	TxID         int64         `json:"tx_id,omitempty"`
+	Dry          bool          `json:"dry,omitempty"`
+	Slow         bool          `json:"slow,omitempty"`
+	Statement    string        `json:"statement,omitempty"`
+	Args         []interface{} `json:"args,omitempty"`
+	DurationMs   float64       `json:"duration_ms"`
+	RowsAffected *int64        `json:"rows_affected,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// getSlowQuery - queries taking at least SLOW_QUERY (Go duration, default 5s) are always logged, 0 disables
+func getSlowQuery() time.Duration {
+	str := os.Getenv("SLOW_QUERY")
+	if str == "" {
+		return 5 * time.Second
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		log.Panicf("cannot parse SLOW_QUERY duration '%s': %v", str, err)
+	}
+	return d
+}
+
+// txID - numeric ID of a transaction used in SQL log, 0 for no transaction
+func txID(tx *sql.Tx) int64 {
+	if tx == nil {
+		return 0
+	}
+	id, _ := gTxIDs.Load(tx)
+	n, _ := id.(int64)
+	return n
+}
+
+// redactArg - convert query argument to its loggable form
+// SQL_REDACT=emails (default) hides arguments looking like email addresses, all - hides all text arguments, none - shows everything
+// malformed emails cleaned up by this tool ('john at example.com') are normalized the same way as when cleaning them, so they are hidden too
+func redactArg(arg interface{}) interface{} {
+	v := reflect.ValueOf(arg)
+	for v.IsValid() && v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	var str string
+	switch a := v.Interface().(type) {
+	case time.Time:
+		return a.Format(time.RFC3339Nano)
+	case []byte:
+		str = string(a)
+	case string:
+		str = a
+	default:
+		return a
+	}
+	switch gSQLRedact {
+	case "none":
+		return str
+	case "all":
+	default:
+		if !strings.Contains(EmailReplacer.Replace(strings.ToLower(str)), "@") {
+			return str
+		}
+	}
+	return fmt.Sprintf("<redacted:%d>", len(str))
+}
+
+// queryOut - display DB operation as a single line JSON log event
+func queryOut(op string, tx *sql.Tx, query string, dur time.Duration, res sql.Result, err error, args ...interface{}) {
+	ev := sqlEvent{
+		Time:       time.Now(),
+		RunID:      gRunID,
+		Op:         op,
+		TxID:       txID(tx),
+		Dry:        gDry,
+		Slow:       gSlowQuery > 0 && dur >= gSlowQuery,
+		Statement:  query,
+		DurationMs: float64(dur.Microseconds()) / 1000.0,
+	}
+	for _, arg := range args {
+		ev.Args = append(ev.Args, redactArg(arg))
+	}
+	if res != nil && err == nil {
+		affected, e := res.RowsAffected()
+		if e == nil {
+			ev.RowsAffected = &affected
+		}
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	data, e := gSQLLogJSON.Marshal(ev)
+	if e != nil {
+		log.Printf("cannot marshal SQL log event: %+v: %+v\n", e, ev)
+		return
+	}
+	fmt.Printf("%s\n", data)
+}
+
+// sqlOut - log DB operation when SQLDEBUG is set, on errors (unless quiet) and when it was slow
+func sqlOut(op string, tx *sql.Tx, query string, quiet bool, start time.Time, res sql.Result, err error, args ...interface{}) {
+	dur := time.Since(start)
+	slow := gSlowQuery > 0 && dur >= gSlowQuery
+	if slow || (!gSQLQuiet && (gSQLOut || (err != nil && !quiet))) {
+		queryOut(op, tx, query, dur, res, err, args...)
+	}
+}
+
+// queryDB - query database without transaction
+func queryDB(ctx context.Context, db *sqlx.DB, query string, quiet bool, args ...interface{}) (rows *sql.Rows, err error) {
+	start := time.Now()
+	rows, err = db.QueryContext(ctx, gDialect.rebind(query), args...)
+	sqlOut("query", nil, query, quiet, start, nil, err, args...)
+	return
+}
+
+// queryTX - query database with transaction
+func queryTX(ctx context.Context, db *sql.Tx, query string, quiet bool, args ...interface{}) (rows *sql.Rows, err error) {
+	start := time.Now()
+	rows, err = db.QueryContext(ctx, gDialect.rebind(query), args...)
+	sqlOut("query", db, query, quiet, start, nil, err, args...)
+	return
+}
+
+// query - query DB using transaction if provided
+func query(ctx context.Context, db *sqlx.DB, tx *sql.Tx, query string, args ...interface{}) (*sql.Rows, error) {
+	if tx == nil {
+		return queryDB(ctx, db, query, false, args...)
+	}
+	return queryTX(ctx, tx, query, false, args...)
+}
+
+// execDB - execute DB query without transaction
+func execDB(ctx context.Context, db *sqlx.DB, query string, quiet bool, args ...interface{}) (res sql.Result, err error) {
+	start := time.Now()
+	res, err = db.ExecContext(ctx, gDialect.rebind(query), args...)
+	sqlOut("exec", nil, query, quiet, start, res, err, args...)
+	return
+}
+
+// execTX - execute DB query with transaction
+func execTX(ctx context.Context, db *sql.Tx, query string, quiet bool, args ...interface{}) (res sql.Result, err error) {
+	start := time.Now()
+	res, err = db.ExecContext(ctx, gDialect.rebind(query), args...)
+	sqlOut("exec", db, query, quiet, start, res, err, args...)
+	return
+}
+
+// exec - execute db query with transaction if provided
+func exec(ctx context.Context, db *sqlx.DB, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	if gDry {
+		if gDebug || gSQLOut {
+			queryOut("exec", tx, query, 0, nil, nil, args...)
+		}
+		return nil, nil
+	}
+	if tx == nil {
+		return execDB(ctx, db, query, false, args...)
+	}
+	return execTX(ctx, tx, query, false, args...)
+}
+
+// execQuiet - execute db query with transaction if provided
+func execQuiet(ctx context.Context, db *sqlx.DB, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	if gDry {
+		if gDebug || gSQLOut {
+			queryOut("exec", tx, query, 0, nil, nil, args...)
+		}
+		return nil, nil
+	}
+	if tx == nil {
+		return execDB(ctx, db, query, true, args...)
+	}
+	return execTX(ctx, tx, query, true, args...)
+}
+
+// getDBRetries - maximum number of retries of a transaction failed on deadlock or lock wait timeout
+// DB_RETRIES, default 5, 0 disables retrying
+func getDBRetries() int {
+	s := os.Getenv("DB_RETRIES")
+	if s == "" {
+		return 5
+	}
+	retries, err := strconv.Atoi(s)
+	if err != nil || retries < 0 {
+		log.Panicf("invalid DB_RETRIES value: '%s'", s)
+	}
+	return retries
+}
+
+// retryBackoff - jittered exponential backoff before attempt-th retry: random value from [d/2, d)
+// where d is 100ms doubled with each attempt, up to 5s
+func retryBackoff(attempt int) time.Duration {
+	d := 100 * time.Millisecond
+	for i := 1; i < attempt && d < 5*time.Second; i++ {
+		d *= 2
+	}
+	if d > 5*time.Second {
+		d = 5 * time.Second
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// countRetry - record a retry (or giving up) caused by reason
+func countRetry(reason string, gaveUp bool) {
+	gDBRetryMtx.Lock()
+	defer gDBRetryMtx.Unlock()
+	if gaveUp {
+		gDBRetries["gave up"]++
+		return
+	}
+	gDBRetries[reason]++
+}
+
+// retryTX - run transaction function f, rerun it when it failed on a transient lock conflict
+// (deadlock, lock wait timeout), f must start its own transaction and roll it back on error
+func retryTX(ctx context.Context, what string, f func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = f()
+		reason := gDialect.retryReason(err)
+		if reason == "" {
+			return
+		}
+		if attempt > gDBRetryMax {
+			countRetry(reason, true)
+			err = fmt.Errorf("%s: giving up after %d retries: %w", what, gDBRetryMax, err)
+			return
+		}
+		countRetry(reason, false)
+		backoff := retryBackoff(attempt)
+		if gDebug {
+			fmt.Printf("%s: %s, retry #%d in %v\n", what, reason, attempt, backoff)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// printRetries - print number of transactions retried due to lock conflicts
+func printRetries() {
+	gDBRetryMtx.Lock()
+	defer gDBRetryMtx.Unlock()
+	if len(gDBRetries) == 0 {
+		return
+	}
+	reasons := []string{}
+	for reason := range gDBRetries {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	items := []string{}
+	for _, reason := range reasons {
+		items = append(items, fmt.Sprintf("%s:%d", reason, gDBRetries[reason]))
+	}
+	fmt.Printf("database retries: %s\n", strings.Join(items, ", "))
+}
+
+// scope - filters limiting rows processed by cleanups, from SCOPE_* environment variables
+type scope struct {
+	sources       []string
+	uuids         []string
+	domains       []string
+	modifiedAfter string
+}
+
+// getScope - parse SCOPE_SOURCES, SCOPE_UUIDS, SCOPE_DOMAINS (comma separated) and SCOPE_MODIFIED_AFTER (date or date and time)
+func getScope() (s scope) {
+	list := func(env string, lower bool) (items []string) {
+		for _, item := range strings.Split(os.Getenv(env), ",") {
+			item = strings.TrimSpace(item)
+			if lower {
+				item = strings.ToLower(item)
+			}
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+		return
+	}
+	s.sources = list("SCOPE_SOURCES", true)
+	s.uuids = list("SCOPE_UUIDS", false)
+	s.domains = list("SCOPE_DOMAINS", true)
+	for i, domain := range s.domains {
+		s.domains[i] = strings.TrimPrefix(domain, "@")
+	}
+	after := strings.TrimSpace(os.Getenv("SCOPE_MODIFIED_AFTER"))
+	if after != "" {
+		var (
+			t   time.Time
+			err error
+		)
+		for _, format := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+			t, err = time.Parse(format, after)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Panicf("invalid SCOPE_MODIFIED_AFTER value: '%s', expected date like 2021-01-31 or 2021-01-31 12:00:00", after)
+		}
+		s.modifiedAfter = t.UTC().Format("2006-01-02 15:04:05")
+	}
+	return
+}
+
+// all - scope has no filters
+func (s scope) all() bool {
+	return len(s.sources) == 0 && len(s.uuids) == 0 && len(s.domains) == 0 && s.modifiedAfter == ""
+}
+
+// String - scope description for the run header
+func (s scope) String() string {
+	items := []string{}
+	if len(s.sources) > 0 {
+		items = append(items, "sources: "+strings.Join(s.sources, ","))
+	}
+	if len(s.uuids) > 0 {
+		items = append(items, "uuids: "+strings.Join(s.uuids, ","))
+	}
+	if len(s.domains) > 0 {
+		items = append(items, "email domains: "+strings.Join(s.domains, ","))
+	}
+	if s.modifiedAfter != "" {
+		items = append(items, "modified after: "+s.modifiedAfter)
+	}
+	if s.all() {
+		return "all rows"
+	}
+	return strings.Join(items, ", ")
+}
+
+// placeholders - '(?,?,...)' for n values
+func placeholders(n int) string {
+	return "(?" + strings.Repeat(",?", n-1) + ")"
+}
+
+// strArgs - strings as query args
+func strArgs(items []string) (args []interface{}) {
+	for _, item := range items {
+		args = append(args, item)
+	}
+	return
+}
+
+// andWhere - join non-empty conditions with 'and'
+func andWhere(conds ...string) string {
+	nonEmpty := []string{}
+	for _, cond := range conds {
+		if cond != "" {
+			nonEmpty = append(nonEmpty, "("+cond+")")
+		}
+	}
+	return strings.Join(nonEmpty, " and ")
+}
+
+// likeEscaper - escape like pattern wildcards using '!' as the escape character (backslash is special in MySQL strings)
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// domainsWhere - email column ends with one of the scope's domains, emails to clean up are often
+// malformed so 'x at domain' and '<x@domain>' match too, subdomains and 'domain.com.evil' do not
+func (s scope) domainsWhere(column string) (where string, args []interface{}) {
+	conds := []string{}
+	for _, domain := range s.domains {
+		// '_' and '%' in domains are matched literally
+		domain = likeEscaper.Replace(domain)
+		for _, pattern := range []string{"%@" + domain, "%@" + domain + ">", "% at " + domain, "% at " + domain + ">"} {
+			conds = append(conds, "lower(trim("+column+")) like ? escape '!'")
+			args = append(args, pattern)
+		}
+	}
+	where = strings.Join(conds, " or ")
+	return
+}
+
+// identitiesWhere - condition limiting identities to the scope
+func (s scope) identitiesWhere() (where string, args []interface{}) {
+	conds := []string{}
+	if len(s.sources) > 0 {
+		conds = append(conds, "lower(source) in "+placeholders(len(s.sources)))
+		args = append(args, strArgs(s.sources)...)
+	}
+	if len(s.uuids) > 0 {
+		conds = append(conds, "uuid in "+placeholders(len(s.uuids)))
+		args = append(args, strArgs(s.uuids)...)
+	}
+	if len(s.domains) > 0 {
+		cond, domainArgs := s.domainsWhere("email")
+		conds = append(conds, cond)
+		args = append(args, domainArgs...)
+	}
+	if s.modifiedAfter != "" {
+		conds = append(conds, "last_modified > ?")
+		args = append(args, s.modifiedAfter)
+	}
+	where = andWhere(conds...)
+	return
+}
+
+// profilesWhere - condition limiting profiles to the scope, profile's unique identity must have
+// an identity from the scope's sources and be modified after the scope's date
+func (s scope) profilesWhere() (where string, args []interface{}) {
+	conds := []string{}
+	if len(s.sources) > 0 {
+		conds = append(conds, "uuid in (select uuid from identities where lower(source) in "+placeholders(len(s.sources))+")")
+		args = append(args, strArgs(s.sources)...)
+	}
+	if len(s.uuids) > 0 {
+		conds = append(conds, "uuid in "+placeholders(len(s.uuids)))
+		args = append(args, strArgs(s.uuids)...)
+	}
+	if len(s.domains) > 0 {
+		cond, domainArgs := s.domainsWhere("email")
+		conds = append(conds, cond)
+		args = append(args, domainArgs...)
+	}
+	if s.modifiedAfter != "" {
+		conds = append(conds, "uuid in (select uuid from uidentities where last_modified > ?)")
+		args = append(args, s.modifiedAfter)
+	}
+	where = andWhere(conds...)
+	return
+}
+
+// uidentitiesWhere - condition limiting unique identities to the scope's uuids and date,
+// sources and domains are not used because they are properties of identities
+func (s scope) uidentitiesWhere() (where string, args []interface{}) {
+	conds := []string{}
+	if len(s.uuids) > 0 {
+		conds = append(conds, "uuid in "+placeholders(len(s.uuids)))
+		args = append(args, strArgs(s.uuids)...)
+	}
+	if s.modifiedAfter != "" {
+		conds = append(conds, "last_modified > ?")
+		args = append(args, s.modifiedAfter)
+	}
+	where = andWhere(conds...)
+	return
+}
+
+// incremental - high-water marks of identities and uidentities last_modified for an operation,
+// rows modified before the marks of the last successful run are skipped
+type incremental struct {
+	Name           string `json:"name"`
+	Identities     string `json:"identities"`
+	UIdentities    string `json:"uidentities"`
+	NewIdentities  string `json:"new_identities"`
+	NewUIdentities string `json:"new_uidentities"`
+}
+
+// initState - create state table if it does not exist
+func initState(ctx context.Context, db *sqlx.DB) error {
+	return retryTX(
+		ctx,
+		"state table",
+		func() (err error) {
+			_, err = execDB(
+				ctx,
+				db,
+				"create table if not exists cleanup_state(name varchar(128) not null primary key, value varchar(255) not null, "+
+					"run_id varchar(64) not null, updated_at datetime(6) not null)",
+				false,
+			)
+			return
+		},
+	)
+}
+
+// getState - read named value from state table, empty if not set
+func getState(ctx context.Context, db *sqlx.DB, name string) (value string, err error) {
+	rows, err := query(ctx, db, nil, "select value from cleanup_state where name = ?", name)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		err = rows.Scan(&value)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// setState - save named value to state table
+func setState(ctx context.Context, db *sqlx.DB, name, value string) error {
+	return retryTX(
+		ctx,
+		"state "+name,
+		func() (err error) {
+			_, err = execDB(ctx, db, gDialect.upsert("cleanup_state", "name", []string{"name", "value", "run_id", "updated_at"}), false, name, value, gRunID, time.Now().UTC())
+			return
+		},
+	)
+}
+
+// maxModified - current maximum last_modified of a table
+func maxModified(ctx context.Context, db *sqlx.DB, table string) (mark string, err error) {
+	rows, err := query(ctx, db, nil, "select max(last_modified) from "+table)
+	if err != nil {
+		return
+	}
+	var value interface{}
+	for rows.Next() {
+		err = rows.Scan(&value)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	switch v := value.(type) {
+	case time.Time:
+		mark = v.Format("2006-01-02 15:04:05.999999")
+	case []byte:
+		mark = string(v)
+	case nil:
+	default:
+		mark = fmt.Sprintf("%v", v)
+	}
+	return
+}
+
+// startIncremental - when INCREMENTAL is set, read marks saved by the last successful run of operation name
+// (unless FULL is set) and take new marks, which are saved by save after this run succeeds, nil otherwise
+// new marks are taken before processing starts, so rows modified during this run are processed again by the next one
+func startIncremental(ctx context.Context, db *sqlx.DB, name string) (inc *incremental, err error) {
+	if os.Getenv("INCREMENTAL") == "" {
+		return
+	}
+	cp := resumeCheckpoint(name)
+	if cp != nil && cp.Incremental != nil {
+		inc = cp.Incremental
+		fmt.Printf("%s: resuming with incremental marks of the run: identities since '%s', unique identities since '%s'\n", name, inc.Identities, inc.UIdentities)
+		return
+	}
+	inc = &incremental{Name: name}
+	inc.NewIdentities, err = maxModified(ctx, db, "identities")
+	if err != nil {
+		return
+	}
+	inc.NewUIdentities, err = maxModified(ctx, db, "uidentities")
+	if err != nil {
+		return
+	}
+	if os.Getenv("FULL") != "" {
+		fmt.Printf("%s: full run requested, processing all rows\n", name)
+		return
+	}
+	inc.Identities, err = getState(ctx, db, name+":identities")
+	if err != nil && gDry {
+		fmt.Printf("%s: cannot read incremental state (%v), processing all rows\n", name, err)
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	inc.UIdentities, err = getState(ctx, db, name+":uidentities")
+	if err != nil {
+		return
+	}
+	if inc.Identities == "" && inc.UIdentities == "" {
+		fmt.Printf("%s: no previous successful run, processing all rows\n", name)
+		return
+	}
+	fmt.Printf("%s: incremental, identities modified since '%s', unique identities modified since '%s'\n", name, inc.Identities, inc.UIdentities)
+	return
+}
+
+// identitiesWhere - condition limiting identities to ones modified since the last successful run
+func (inc *incremental) identitiesWhere() (where string, args []interface{}) {
+	if inc == nil || inc.Identities == "" {
+		return
+	}
+	return "last_modified >= ?", []interface{}{inc.Identities}
+}
+
+// profilesWhere - condition limiting profiles to ones whose unique identity was modified since the last successful run
+func (inc *incremental) profilesWhere() (where string, args []interface{}) {
+	if inc == nil || inc.UIdentities == "" {
+		return
+	}
+	return "uuid in (select uuid from uidentities where last_modified >= ?)", []interface{}{inc.UIdentities}
+}
+
+// save - save marks taken at start, unless the run is dry, was stopped or limited to a scope
+func (inc *incremental) save(ctx context.Context, db *sqlx.DB) (err error) {
+	if inc == nil || gDry || isStopping() {
+		return
+	}
+	if !gScope.all() {
+		fmt.Printf("%s: run limited to a scope, incremental state not saved\n", inc.Name)
+		return
+	}
+	if inc.NewIdentities != "" {
+		err = setState(ctx, db, inc.Name+":identities", inc.NewIdentities)
+		if err != nil {
+			return
+		}
+	}
+	if inc.NewUIdentities != "" {
+		err = setState(ctx, db, inc.Name+":uidentities", inc.NewUIdentities)
+	}
+	return
+}
+
+// checkpoint - progress of a run saved at CHECKPOINT_INTERVAL next to its backup, used to resume it with RESUME=<run-id>
+type checkpoint struct {
+	RunID string                   `json:"run_id"`
+	Time  time.Time                `json:"time"`
+	Ops   map[string]*opCheckpoint `json:"ops"`
+}
+
+// opCheckpoint - progress of an operation: all rows of Phase with key <= Key were processed and committed
+// (empty Key - phase not started), Phase is "done" for completed operations
+type opCheckpoint struct {
+	Phase       string         `json:"phase"`
+	Key         string         `json:"key"`
+	Counters    map[string]int `json:"counters"`
+	Incremental *incremental   `json:"incremental,omitempty"`
+}
+
+var (
+	gCheckpoint    *checkpoint
+	gCheckpointMtx = &sync.Mutex{}
+	gResumed       bool
+)
+
+// checkpointer - saves progress of an operation's phase
+type checkpointer struct {
+	op       string
+	phase    string
+	inc      *incremental
+	interval time.Duration
+	last     time.Time
+	failed   bool
+}
+
+// getCheckpointInterval - CHECKPOINT_INTERVAL, Go duration, default 1m, 0 disables checkpoints
+func getCheckpointInterval() time.Duration {
+	s := os.Getenv("CHECKPOINT_INTERVAL")
+	if s == "" {
+		return time.Minute
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		log.Panicf("invalid CHECKPOINT_INTERVAL value: '%s', expected Go duration like 30s or 5m", s)
+	}
+	return d
+}
+
+// checkpointFileName - checkpoint file of a run, stored next to its backup
+func checkpointFileName(runID string) string {
+	return strings.TrimSuffix(backupFileName(runID), ".json") + ".checkpoint.json"
+}
+
+// loadCheckpoint - load checkpoint of run RESUME, it is used by operations to skip already processed rows
+func loadCheckpoint(runID string) (err error) {
+	fn := checkpointFileName(runID)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return
+	}
+	var cp checkpoint
+	err = jsoniter.Unmarshal(data, &cp)
+	if err != nil {
+		return
+	}
+	if cp.RunID != runID {
+		err = fmt.Errorf("checkpoint %s is for run %s", fn, cp.RunID)
+		return
+	}
+	if cp.Ops == nil {
+		cp.Ops = make(map[string]*opCheckpoint)
+	}
+	gCheckpoint = &cp
+	gResumed = true
+	fmt.Printf("resuming run %s from checkpoint saved at %v\n", runID, cp.Time)
+	for op, opCP := range cp.Ops {
+		fmt.Printf("%s: phase %s, key '%s'\n", op, opCP.Phase, opCP.Key)
+	}
+	return
+}
+
+// resumeCheckpoint - saved progress of operation op when resuming a run, nil otherwise
+func resumeCheckpoint(op string) *opCheckpoint {
+	if !gResumed || gCheckpoint == nil {
+		return nil
+	}
+	gCheckpointMtx.Lock()
+	defer gCheckpointMtx.Unlock()
+	return gCheckpoint.Ops[op]
+}
+
+// saveCheckpoint - save progress of operation op, the file is replaced atomically
+func saveCheckpoint(op string, cp *opCheckpoint) (err error) {
+	if gDry {
+		return
+	}
+	gCheckpointMtx.Lock()
+	defer gCheckpointMtx.Unlock()
+	if gCheckpoint == nil {
+		gCheckpoint = &checkpoint{RunID: gRunID, Ops: make(map[string]*opCheckpoint)}
+	}
+	gCheckpoint.Time = time.Now()
+	gCheckpoint.Ops[op] = cp
+	data, err := jsoniter.Marshal(gCheckpoint)
+	if err != nil {
+		return
+	}
+	fn := checkpointFileName(gRunID)
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(fn+".tmp", data, 0644)
+	if err != nil {
+		return
+	}
+	err = os.Rename(fn+".tmp", fn)
+	if err == nil && gDebug {
+		fmt.Printf("%s: checkpoint %s '%s' saved\n", op, cp.Phase, cp.Key)
+	}
+	return
+}
+
+// newCheckpointer - start checkpointing phase of operation op, inc are incremental marks used by the operation
+func newCheckpointer(op, phase string, inc *incremental) *checkpointer {
+	return &checkpointer{op: op, phase: phase, inc: inc, interval: getCheckpointInterval(), last: time.Now()}
+}
+
+// due - should progress be saved now? once an error happened progress is not saved anymore, so the run
+// can be resumed from the last point where all rows before it were committed
+func (c *checkpointer) due() bool {
+	return !c.failed && c.interval > 0 && time.Since(c.last) >= c.interval
+}
+
+// save - save progress: rows of the phase with key <= key were committed, when errs is not empty nothing is saved
+// and checkpointing of the phase stops
+func (c *checkpointer) save(key string, counters map[string]int, errs []error) {
+	if c.failed || c.interval == 0 {
+		return
+	}
+	if len(errs) > 0 {
+		c.failed = true
+		return
+	}
+	c.last = time.Now()
+	err := saveCheckpoint(c.op, &opCheckpoint{Phase: c.phase, Key: key, Counters: counters, Incremental: c.inc})
+	if err != nil {
+		fmt.Printf("%s: cannot save checkpoint: %+v\n", c.op, err)
+	}
+}
+
+// next - phase completed, save the start of the next one
+func (c *checkpointer) next(phase string, counters map[string]int, errs []error) {
+	c.phase = phase
+	c.save("", counters, errs)
+}
+
+// getPageSize - number of rows fetched by a single scan query, PAGE_SIZE, defaults to 10000
+func getPageSize() int {
+	pageSize, err := strconv.Atoi(os.Getenv("PAGE_SIZE"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 10000
+	}
+	return pageSize
+}
+
+// scanPages - keyset paginate rows of a table ordered by unique key column keyCol
+// only one page of rows is read at a time, so memory usage does not depend on table size
+// scan is called for each row and must return row's key value (keyCol must be selected)
+// page (if not nil) is called after each page is read and its cursor is closed, it returns errStopped
+// when it stops dispatching rows because the run is being stopped
+// returns the number of rows scanned
+func scanPages(ctx context.Context, db *sqlx.DB, columns, table, keyCol, where string, args []interface{}, scan func(*sql.Rows) (string, error), page func() error) (n int, err error) {
+	pageSize := getPageSize()
+	cond := ""
+	if where != "" {
+		cond = "(" + where + ") and "
+	}
+	sel := "select " + columns + " from " + table + " where " + cond + keyCol + " > ? order by " + keyCol + " limit ?"
+	lastKey := ""
+	for {
+		if isStopping() {
+			unprocessed("%s: rows with %s > '%s' where %s %v", table, keyCol, lastKey, where, args)
+			return
+		}
+		var rows *sql.Rows
+		rows, err = query(ctx, readDB(db), nil, sel, append(append([]interface{}{}, args...), lastKey, pageSize)...)
+		if err != nil {
+			return
+		}
+		got := 0
+		for rows.Next() {
+			lastKey, err = scan(rows)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			got++
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		n += got
+		if page != nil {
+			err = page()
+			if err == errStopped {
+				err = nil
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+		if got < pageSize {
+			return
+		}
+	}
+}
+
+// getBatchSize - number of changes written in a single transaction, BATCH_SIZE, defaults to 500
+func getBatchSize() int {
+	batchSize, err := strconv.Atoi(os.Getenv("BATCH_SIZE"))
+	if err != nil || batchSize <= 0 {
+		batchSize = 500
+	}
+	return batchSize
+}
+
+// batchWriter - groups changes added by concurrent workers and writes them size at a time
+type batchWriter struct {
+	size    int
+	mtx     *sync.Mutex
+	pending []interface{}
+	write   func([]interface{}) error
+}
+
+// newBatchWriter - create batch writer calling write for each batch of changes
+func newBatchWriter(size int, write func([]interface{}) error) *batchWriter {
+	return &batchWriter{size: size, mtx: &sync.Mutex{}, write: write}
+}
+
+// add - add change, writes a batch when enough changes are pending
+// batch is written by the goroutine that filled it, so other workers are not blocked
+func (w *batchWriter) add(change interface{}) error {
+	w.mtx.Lock()
+	w.pending = append(w.pending, change)
+	if len(w.pending) < w.size {
+		w.mtx.Unlock()
+		return nil
+	}
+	batch := w.pending
+	w.pending = nil
+	w.mtx.Unlock()
+	return w.write(batch)
+}
+
+// flush - write all pending changes
+func (w *batchWriter) flush() error {
+	w.mtx.Lock()
+	batch := w.pending
+	w.pending = nil
+	w.mtx.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	return w.write(batch)
+}
+
+// workerPool - runs tasks using at most thrN goroutines and collects their errors
+// each task must send its result to the channel it gets (it gets nil when running in the main goroutine)
+type workerPool struct {
+	thrN     int
+	nThreads int
+	ch       chan error
+	errs     []error
+}
+
+// newWorkerPool - create a pool, tasks run synchronously when thrN is not positive
+func newWorkerPool(thrN int) *workerPool {
+	return &workerPool{thrN: thrN, ch: make(chan error), errs: []error{}}
+}
+
+// run - run task, waits for one of running tasks to finish when all threads are busy
+func (p *workerPool) run(task func(chan error) error) {
+	if p.thrN <= 0 {
+		e := task(nil)
+		if e != nil {
+			p.errs = append(p.errs, e)
+		}
+		return
+	}
+	go func(ch chan error) {
+		_ = task(ch)
+	}(p.ch)
+	p.nThreads++
+	if p.nThreads == p.thrN {
+		p.collect()
+	}
+}
+
+// collect - wait for one running task
+func (p *workerPool) collect() {
+	e := <-p.ch
+	p.nThreads--
+	if e != nil {
+		p.errs = append(p.errs, e)
+	}
+}
+
+// wait - wait for all running tasks and return collected errors
+func (p *workerPool) wait() []error {
+	for p.nThreads > 0 {
+		p.collect()
+	}
+	return p.errs
+}
+
+// isStopping - was the run asked to stop? no new items are dispatched then
+func isStopping() bool {
+	select {
+	case <-gStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// unprocessed - record items left unprocessed because the run was stopped
+func unprocessed(format string, args ...interface{}) {
+	gUnprocMtx.Lock()
+	gUnprocessed = append(gUnprocessed, fmt.Sprintf(format, args...))
+	gUnprocMtx.Unlock()
+}
+
+// printUnprocessed - display items left unprocessed
+func printUnprocessed() {
+	gUnprocMtx.Lock()
+	defer gUnprocMtx.Unlock()
+	if len(gUnprocessed) == 0 {
+		return
+	}
+	fmt.Printf("%d items left unprocessed:\n", len(gUnprocessed))
+	for _, item := range gUnprocessed {
+		fmt.Printf("%s\n", item)
+	}
+}
+
+// handleSignals - first SIGINT/SIGTERM stops dispatching new items and lets in-flight ones finish,
+// second one cancels the context, so in-flight DB operations and API calls are aborted and rolled back
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Printf("%v received, stopping: waiting for in-flight items, send it again to roll them back\n", sig)
+		stopRun()
+		sig = <-sigs
+		fmt.Printf("%v received again, cancelling in-flight items\n", sig)
+		cancel()
+	}()
+}
+
+// stopRun - stop dispatching new items, can be called more than once (signal, circuit breaker)
+func stopRun() {
+	gStopOnce.Do(func() { close(gStop) })
+}
+
+// Process exit codes
+const (
+	exitOK        = 0
+	exitAPIToken  = 3
+	exitPlanWrite = 4
+	exitRunLocked = 5
+)
+
+// errAPIToken - API token cannot be obtained, no API call can succeed then
+var errAPIToken = errors.New("cannot obtain API token")
+
+// errPlanWrite - plan entry cannot be saved, the plan would be incomplete then
+var errPlanWrite = errors.New("cannot write plan entry to")
+
+// errRunLocked - run lock is held by another run, the run refuses to start
+var errRunLocked = errors.New("run lock is held by another run")
+
+var (
+	gAbortErr error
+	gAbortMtx = &sync.Mutex{}
+)
+
+// abortRun - stop the run because of err which makes continuing pointless, in-flight items are finished
+// and reports are flushed like on SIGINT, the first such error determines the exit code
+func abortRun(err error) {
+	gAbortMtx.Lock()
+	if gAbortErr == nil {
+		gAbortErr = err
+		fmt.Printf("aborting run: %v\n", err)
+	}
+	gAbortMtx.Unlock()
+	stopRun()
+}
+
+// exitCode - process exit code: specific to the error which aborted the run, exitOK otherwise
+func exitCode() int {
+	gAbortMtx.Lock()
+	defer gAbortMtx.Unlock()
+	switch {
+	case errors.Is(gAbortErr, errAPIToken):
+		fmt.Printf("run aborted: %v\n", gAbortErr)
+		return exitAPIToken
+	case errors.Is(gAbortErr, errPlanWrite):
+		fmt.Printf("run aborted: %v\n", gAbortErr)
+		return exitPlanWrite
+	case errors.Is(gAbortErr, errRunLocked):
+		return exitRunLocked
+	}
+	return exitOK
+}
+
+// Circuit breaker metrics
+const (
+	breakBlanked     = "blanked_emails"
+	breakIdentities  = "deleted_identities"
+	breakMerges      = "merges"
+	breakUIdentities = "deleted_uidentities"
+)
+
+// breakerLimit - metric's threshold: absolute number of changes and percentage of scanned rows, 0 - not set
+type breakerLimit struct {
+	abs int
+	pct float64
+}
+
+// circuitBreaker - counts changes per metric and stops the run once any of them crosses its threshold
+// percentage thresholds are checked only after at least minRows rows were scanned for the metric
+type circuitBreaker struct {
+	mtx     *sync.Mutex
+	limits  map[string]breakerLimit
+	counts  map[string]int
+	scanned map[string]int
+	minRows int
+	force   bool
+	forced  map[string]bool
+	tripped string
+}
+
+var (
+	gBreaker  *circuitBreaker
+	gStopOnce = &sync.Once{}
+)
+
+// getBreakerLimit - parse threshold from env: '1000', '5%' or '1000,5%'
+func getBreakerLimit(env string) (limit breakerLimit) {
+	s := os.Getenv(env)
+	if s == "" {
+		return
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var err error
+		if strings.HasSuffix(part, "%") {
+			limit.pct, err = strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+			if err == nil && (limit.pct <= 0 || limit.pct > 100) {
+				err = fmt.Errorf("percentage out of range")
+			}
+		} else {
+			limit.abs, err = strconv.Atoi(part)
+			if err == nil && limit.abs <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		}
+		if err != nil {
+			log.Panicf("invalid %s value: '%s', expected number, percentage or both like '1000,5%%': %v", env, s, err)
+		}
+	}
+	return
+}
+
+// getBreaker - circuit breaker configured by BREAKER_* env variables
+func getBreaker() *circuitBreaker {
+	b := &circuitBreaker{
+		mtx:     &sync.Mutex{},
+		limits:  map[string]breakerLimit{},
+		counts:  map[string]int{},
+		scanned: map[string]int{},
+		minRows: 1000,
+		force:   os.Getenv("BREAKER_FORCE") != "",
+		forced:  map[string]bool{},
+	}
+	for _, metric := range []string{breakBlanked, breakIdentities, breakMerges, breakUIdentities} {
+		limit := getBreakerLimit("BREAKER_" + strings.ToUpper(metric))
+		if limit.abs > 0 || limit.pct > 0 {
+			b.limits[metric] = limit
+		}
+	}
+	s := os.Getenv("BREAKER_MIN_ROWS")
+	if s != "" {
+		var err error
+		b.minRows, err = strconv.Atoi(s)
+		if err != nil || b.minRows < 0 {
+			log.Panicf("invalid BREAKER_MIN_ROWS value: '%s'", s)
+		}
+	}
+	return b
+}
+
+// String - thresholds description
+func (b *circuitBreaker) String() string {
+	if len(b.limits) == 0 {
+		return "no thresholds"
+	}
+	limits := []string{}
+	for _, metric := range []string{breakBlanked, breakIdentities, breakMerges, breakUIdentities} {
+		limit, ok := b.limits[metric]
+		if !ok {
+			continue
+		}
+		s := metric + ":"
+		if limit.abs > 0 {
+			s += fmt.Sprintf(" %d", limit.abs)
+		}
+		if limit.pct > 0 {
+			s += fmt.Sprintf(" %g%% (after %d rows)", limit.pct, b.minRows)
+		}
+		limits = append(limits, s)
+	}
+	s := strings.Join(limits, ", ")
+	if b.force {
+		s += " (forced, not enforced)"
+	}
+	return s
+}
+
+// exceeded - describe threshold crossed by count changes of metric, "" if none, must be called with mtx locked
+func (b *circuitBreaker) exceeded(metric string, count int) string {
+	limit, ok := b.limits[metric]
+	if !ok {
+		return ""
+	}
+	if limit.abs > 0 && count > limit.abs {
+		return fmt.Sprintf("%s: %d > %d", metric, count, limit.abs)
+	}
+	scanned := b.scanned[metric]
+	if limit.pct > 0 && scanned > 0 && scanned >= b.minRows && float64(count)*100 > limit.pct*float64(scanned) {
+		return fmt.Sprintf("%s: %d of %d scanned rows > %g%%", metric, count, scanned, limit.pct)
+	}
+	return ""
+}
+
+// trip - stop the run because metric crossed its threshold, only warns (once per metric) when forced, must be called with mtx locked
+func (b *circuitBreaker) trip(metric, reason string) {
+	if b.force {
+		if !b.forced[metric] {
+			b.forced[metric] = true
+			fmt.Printf("circuit breaker threshold crossed, continuing because of BREAKER_FORCE: %s\n", reason)
+		}
+		return
+	}
+	if b.tripped != "" {
+		return
+	}
+	b.tripped = reason
+	fmt.Printf("circuit breaker tripped, stopping: %s\n", reason)
+	stopRun()
+}
+
+// scan - count rows scanned for metrics
+func (b *circuitBreaker) scan(n int, metrics ...string) {
+	b.mtx.Lock()
+	for _, metric := range metrics {
+		b.scanned[metric] += n
+	}
+	b.mtx.Unlock()
+}
+
+// add - count n changes of metric, trips the breaker when a threshold is crossed
+func (b *circuitBreaker) add(metric string, n int) {
+	if n == 0 {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.counts[metric] += n
+	reason := b.exceeded(metric, b.counts[metric])
+	if reason != "" {
+		b.trip(metric, reason)
+	}
+}
+
+// allow - check that n more changes of metric would not cross a threshold before making them and reserve them,
+// so concurrent writers cannot cross it together, trips the breaker and returns false (reserving nothing) otherwise
+// changes reserved must be settled with the number of changes actually made
+func (b *circuitBreaker) allow(metric string, n int) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	reason := b.exceeded(metric, b.counts[metric]+n)
+	if reason != "" {
+		b.trip(metric, reason)
+		if !b.force {
+			return false
+		}
+	}
+	b.counts[metric] += n
+	return true
+}
+
+// settle - replace n changes of metric reserved by allow with the number of changes actually made,
+// changes not made (rolled back, rows changed concurrently) are released
+func (b *circuitBreaker) settle(metric string, reserved, made int) {
+	if made > reserved {
+		b.add(metric, made-reserved)
+		return
+	}
+	b.mtx.Lock()
+	b.counts[metric] -= reserved - made
+	b.mtx.Unlock()
+}
+
+// isTripped - did the breaker stop the run? changes not yet written must not be written then
+func (b *circuitBreaker) isTripped() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.tripped != ""
+}
+
+// report - print counted changes and the threshold that stopped the run
+func (b *circuitBreaker) report() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if len(b.counts) > 0 {
+		fmt.Printf("circuit breaker: blanked emails:%d, deleted identities:%d, merges:%d, deleted uidentities:%d\n", b.counts[breakBlanked], b.counts[breakIdentities], b.counts[breakMerges], b.counts[breakUIdentities])
+	}
+	if b.tripped != "" {
+		fmt.Printf("run aborted by circuit breaker: %s, use BREAKER_FORCE=1 to override\n", b.tripped)
+	}
+}
+
+// runLock - cross-process lock held by a modifying run, stored as a row in cleanup_run_lock table
+// the row is refreshed periodically and can be taken over when its heartbeat is older than RUN_LOCK_STALE
+type runLock struct {
+	db   *sqlx.DB
+	done chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// runLockName - name of the lock row used by modifying runs
+const runLockName = "cleanup"
+
+// getRunLockDuration - get lock related duration from environment, dflt if not set
+func getRunLockDuration(env string, dflt time.Duration) time.Duration {
+	s := os.Getenv(env)
+	if s == "" {
+		return dflt
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		log.Panicf("invalid %s value: '%s', expected Go duration like 30s or 5m", env, s)
+	}
+	return d
+}
+
+// runLockOwner - host and user running this process
+func runLockOwner() (host, userName string) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	u, err := user.Current()
+	if err == nil {
+		userName = u.Username
+	} else {
+		userName = os.Getenv("USER")
+	}
+	return
+}
+
+// acquireRunLock - take run lock, when another run holds it wait up to RUN_LOCK_WAIT (default 0 - refuse to start)
+// lock held by a run whose heartbeat is older than RUN_LOCK_STALE (default 10m) is taken over
+func acquireRunLock(ctx context.Context, db *sqlx.DB) (lock *runLock, err error) {
+	wait := getRunLockDuration("RUN_LOCK_WAIT", 0)
+	stale := getRunLockDuration("RUN_LOCK_STALE", 10*time.Minute)
+	err = retryTX(
+		ctx,
+		"run lock table",
+		func() (e error) {
+			_, e = execDB(
+				ctx,
+				db,
+				"create table if not exists cleanup_run_lock(name varchar(64) not null primary key, run_id varchar(64) not null, "+
+					"host varchar(255) not null, user_name varchar(255) not null, started_at datetime not null, heartbeat datetime not null)",
+				false,
+			)
+			return
+		},
+	)
+	if err != nil {
+		return
+	}
+	host, userName := runLockOwner()
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		err = retryTX(
+			ctx,
+			"run lock",
+			func() (e error) {
+				now := time.Now().UTC()
+				_, e = execDB(
+					ctx,
+					db,
+					"insert into cleanup_run_lock(name, run_id, host, user_name, started_at, heartbeat) values(?, ?, ?, ?, ?, ?)",
+					true,
+					runLockName,
+					gRunID,
+					host,
+					userName,
+					now,
+					now,
+				)
+				return
+			},
+		)
+		if err == nil {
+			break
+		}
+		if !isDuplicateKeyError(err) {
+			return
+		}
+		var (
+			rows                      *sql.Rows
+			runID, lockHost, lockUser string
+			startedAt, heartbeat      time.Time
+			found                     bool
+		)
+		rows, err = queryDB(ctx, db, "select run_id, host, user_name, started_at, heartbeat from cleanup_run_lock where name = ?", false, runLockName)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			err = rows.Scan(&runID, &lockHost, &lockUser, &startedAt, &heartbeat)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			found = true
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		if !found {
+			continue
+		}
+		if stale > 0 && time.Since(heartbeat) > stale {
+			fmt.Printf("taking over stale run lock held by run %s (host %s, user %s, started %v, last heartbeat %v)\n", runID, lockHost, lockUser, startedAt, heartbeat)
+			_, err = execDB(ctx, db, "delete from cleanup_run_lock where name = ? and run_id = ?", false, runLockName, runID)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("%w: run %s (host %s, user %s, started %v) is in progress", errRunLocked, runID, lockHost, lockUser, startedAt)
+			return
+		}
+		if !waiting {
+			fmt.Printf("waiting up to %v for run %s (host %s, user %s, started %v) to finish\n", wait, runID, lockHost, lockUser, startedAt)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-gStop:
+			err = errStopped
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+	fmt.Printf("run lock acquired by run %s (host %s, user %s)\n", gRunID, host, userName)
+	lock = &runLock{db: db, done: make(chan struct{}), wg: &sync.WaitGroup{}}
+	interval := time.Minute
+	if stale > 0 && stale/3 < interval {
+		interval = stale / 3
+	}
+	lock.wg.Add(1)
+	go func() {
+		defer lock.wg.Done()
+		for {
+			select {
+			case <-lock.done:
+				return
+			case <-time.After(interval):
+			}
+			_, e := execDB(context.Background(), db, "update cleanup_run_lock set heartbeat = ? where name = ? and run_id = ?", false, time.Now().UTC(), runLockName, gRunID)
+			if e != nil {
+				fmt.Printf("run lock heartbeat error: %+v\n", e)
+			}
+		}
+	}()
+	return
+}
+
+// release - stop heartbeat and remove run lock row
+func (l *runLock) release() {
+	close(l.done)
+	l.wg.Wait()
+	_, err := execDB(context.Background(), l.db, "delete from cleanup_run_lock where name = ? and run_id = ?", false, runLockName, gRunID)
+	if err != nil {
+		fmt.Printf("release run lock error: %+v\n", err)
+	}
+}
+
+func getThreadsNum() (thrN int) {
+	defer func() {
+		MT = thrN > 1
+		if MT {
+			emailsCacheMtx = &sync.RWMutex{}
+			uuidsAffsCacheMtx = &sync.RWMutex{}
+		}
+	}()
+	nCPUsStr := os.Getenv("N_CPUS")
+	nCPUs := 0
+	if nCPUsStr != "" {
+		var err error
+		nCPUs, err = strconv.Atoi(nCPUsStr)
+		if err != nil || nCPUs < 0 {
+			nCPUs = 0
+		}
+	}
+	if nCPUs > 0 {
+		n := runtime.NumCPU()
+		if nCPUs > n {
+			nCPUs = n
+		}
+		runtime.GOMAXPROCS(nCPUs)
+		thrN = nCPUs
+		return
+	}
+	thrN = runtime.NumCPU()
+	runtime.GOMAXPROCS(thrN)
+	return
+}
+
+func initializeAuth0() error {
+	var err error
+	auth0DataB64 := os.Getenv("AUTH0_DATA")
+	if auth0DataB64 == "" {
+		return fmt.Errorf("you must specify AUTH0_DATA (so the program can generate an API token) or specify token with JWT_TOKEN")
+	}
+	var auth0Data []byte
+	auth0Data, err = base64.StdEncoding.DecodeString(auth0DataB64)
+	if err != nil {
+		fmt.Printf("decode base64 error: %+v\n", err)
+		return err
+	}
+	var data map[string]string
+	err = jsoniter.Unmarshal([]byte(auth0Data), &data)
+	if err != nil {
+		fmt.Printf("unmarshal error: %+v\n", err)
+		return err
+	}
+	// Providers
+	httpClientProvider := dahttp.NewClientProvider(60 * time.Second)
+	esCacheClientProvider, err := elastic.NewClientProvider(
+		&elastic.Params{
+			URL:      data["es_url"],
+			Username: data["es_user"],
+			Password: data["es_pass"],
+		})
+	if err != nil {
+		fmt.Printf("ES client provider error: %+v\n", err)
+		return err
+	}
+	slackProvider := slack.New(data["slack_webhook_url"])
+	gAuth0Client, err = auth0.NewAuth0Client(
+		data["env"],
+		data["grant_type"],
+		data["client_id"],
+		data["client_secret"],
+		data["audience"],
+		data["url"],
+		httpClientProvider,
+		esCacheClientProvider,
+		&slackProvider,
+		"identity-profile-cleanup",
+	)
+	if err == nil {
+		gTokenEnv = data["env"]
+	}
+	return err
+}
+
+func getAPIToken() (string, error) {
+	envToken := os.Getenv("JWT_TOKEN")
+	if envToken != "" {
+		return envToken, nil
+	}
+	if gTokenEnv == "" {
+		err := initializeAuth0()
+		if err != nil {
+			return "", err
+		}
+	}
+	token, err := gAuth0Client.GetToken()
+	if err == nil && token != "" {
+		token = "Bearer " + token
+	}
+	return token, err
+}
+
+// tokenSource - source of API authorization header values
+type tokenSource interface {
+	// token - current token, obtained when there is none yet
+	token(ctx context.Context) (string, error)
+	// refresh - obtain a new token after the API rejected the current one
+	refresh(ctx context.Context, rejected string) (string, error)
+}
+
+// jwtExpiry - expiry time from JWT exp claim, zero time if the token is not a JWT or has no exp claim
+func jwtExpiry(token string) time.Time {
+	token = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(token), "Bearer "))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	err = jsoniter.Unmarshal(data, &claims)
+	if err != nil || claims.Exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.Exp), 0)
+}
+
+// apiTokenRetry - interval of token refresh retries: after a failed refresh and while the token issuer keeps
+// returning the current token (it can cache tokens until close to their expiry)
+const apiTokenRetry = time.Minute
+
+// jwtTokenManager - token source generating tokens from AUTH0_DATA, refreshed proactively before their JWT exp
+// (API_TOKEN_REFRESH_BEFORE, default 5m, at most half of the token lifetime) or when the API rejects them,
+// concurrent callers share one in-flight refresh. JWT_TOKEN is a static override which is never refreshed,
+// a warning is printed when it is near its expiry. Obtaining a token is retried (API_RETRIES) with backoff,
+// its failure is then cached for apiTokenRetry, so workers do not try again one after another, but when
+// a proactive refresh fails the current token is used while it is valid
+type jwtTokenManager struct {
+	mtx       *sync.Mutex
+	value     string
+	expiry    time.Time
+	refreshAt time.Time
+	static    bool
+	warned    bool
+	before    time.Duration
+	retries   int
+	inflight  chan struct{}
+	err       error
+	errAt     time.Time
+}
+
+// newJWTTokenManager - token manager using JWT_TOKEN or getAPIToken
+func newJWTTokenManager() *jwtTokenManager {
+	m := &jwtTokenManager{
+		mtx:     &sync.Mutex{},
+		before:  getAPIDuration("API_TOKEN_REFRESH_BEFORE", 5*time.Minute),
+		retries: getAPIRetries(),
+	}
+	envToken := os.Getenv("JWT_TOKEN")
+	if envToken != "" {
+		m.static = true
+		m.set(envToken)
+	}
+	return m
+}
+
+// set - use token, schedule its refresh, must be called with mtx locked
+// a token that is not newer than the current one is refreshed again after apiTokenRetry, so refresh time does not
+// keep moving closer to the same expiry with each refresh
+func (m *jwtTokenManager) set(token string) {
+	expiry := jwtExpiry(token)
+	unchanged := m.value != "" && (token == m.value || (!m.expiry.IsZero() && !expiry.After(m.expiry)))
+	m.value = token
+	m.expiry = expiry
+	m.refreshAt = time.Time{}
+	if m.expiry.IsZero() {
+		return
+	}
+	if unchanged {
+		m.refreshAt = time.Now().Add(apiTokenRetry)
+		if gDebug {
+			fmt.Printf("API token not renewed, it expires at %v, refresh again at %v\n", m.expiry, m.refreshAt)
+		}
+		return
+	}
+	before := m.before
+	lifetime := time.Until(m.expiry)
+	if lifetime/2 < before {
+		before = lifetime / 2
+	}
+	m.refreshAt = m.expiry.Add(-before)
+	if gDebug {
+		fmt.Printf("API token expires at %v, refresh at %v\n", m.expiry, m.refreshAt)
+	}
+}
+
+// valid - can the current token still be used? must be called with mtx locked
+func (m *jwtTokenManager) valid() bool {
+	return m.value != "" && (m.expiry.IsZero() || time.Now().Before(m.expiry))
+}
+
+// fetch - obtain a new token unless another caller is already doing it, then wait for it
+// callers having a valid token (proactive refresh) do not wait for other caller's refresh,
+// must be called with mtx locked, returns with mtx locked
+func (m *jwtTokenManager) fetch(ctx context.Context) {
+	if m.inflight != nil {
+		if m.valid() {
+			return
+		}
+		ch := m.inflight
+		m.mtx.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+		}
+		m.mtx.Lock()
+		return
+	}
+	ch := make(chan struct{})
+	m.inflight = ch
+	// a proactive refresh is tried once, it is retried later while the current token is valid
+	retries := m.retries
+	if m.valid() {
+		retries = 0
+	}
+	m.mtx.Unlock()
+	var (
+		token string
+		err   error
+	)
+	for attempt := 1; ; attempt++ {
+		if gDebug || attempt == 1 {
+			fmt.Printf("obtaining API token\n")
+		}
+		token, err = getAPIToken()
+		if err == nil && token == "" {
+			err = fmt.Errorf("empty API token")
+		}
+		if err == nil || attempt > retries {
+			break
+		}
+		backoff := apiBackoff(attempt)
+		fmt.Printf("API token error, retry #%d in %v: %+v\n", attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	m.mtx.Lock()
+	m.inflight = nil
+	close(ch)
+	switch {
+	case err == nil:
+		m.set(token)
+	case m.valid():
+		// proactive refresh failed, try again later, current token is still valid
+		fmt.Printf("API token refresh error, using current token valid until %v: %+v\n", m.expiry, err)
+		m.refreshAt = time.Now().Add(apiTokenRetry)
+	default:
+		m.err = err
+		m.errAt = time.Now()
+	}
+}
+
+func (m *jwtTokenManager) token(ctx context.Context) (token string, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.static {
+		if !m.warned && !m.expiry.IsZero() && time.Until(m.expiry) < m.before {
+			m.warned = true
+			fmt.Printf("warning: JWT_TOKEN expires at %v and is not refreshed, unset it to generate tokens from AUTH0_DATA\n", m.expiry)
+		}
+		return m.value, nil
+	}
+	// cached failure expires, so a later call tries again
+	if m.err != nil && time.Since(m.errAt) >= apiTokenRetry {
+		m.err = nil
+	}
+	if m.err == nil && (!m.valid() || (!m.refreshAt.IsZero() && time.Now().After(m.refreshAt))) {
+		m.fetch(ctx)
+	}
+	if m.err != nil {
+		return "", m.err
+	}
+	if !m.valid() {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("API token expired at %v", m.expiry)
+	}
+	return m.value, nil
+}
+
+func (m *jwtTokenManager) refresh(ctx context.Context, rejected string) (token string, err error) {
+	m.mtx.Lock()
+	if m.static {
+		m.mtx.Unlock()
+		fmt.Printf("warning: JWT_TOKEN was rejected by the API\n")
+		return rejected, nil
+	}
+	// other caller could already replace the rejected token
+	if m.value == rejected && m.err == nil {
+		fmt.Printf("token is invalid, trying to generate another one\n")
+		m.value = ""
+	}
+	m.mtx.Unlock()
+	return m.token(ctx)
+}
+
+// apiLimiter - token bucket limiting API calls to rate per second with burst, shared by all workers
+// the rate is halved when average latency or error rate of recent calls rise above their limits
+// (then at least 5 calls must be made at the new rate before it is halved again) and recovers slowly
+// back to the configured rate when they are normal again
+type apiLimiter struct {
+	mtx     *sync.Mutex
+	maxRate float64
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	latency time.Duration
+	errRate float64
+	slow    time.Duration
+	maxErrs float64
+	calls   int
+	lowest  float64
+}
+
+// getAPIFloat - get non-negative number from environment, dflt if not set
+func getAPIFloat(env string, dflt float64) float64 {
+	s := os.Getenv(env)
+	if s == "" {
+		return dflt
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		log.Panicf("invalid %s value: '%s'", env, s)
+	}
+	return f
+}
+
+// newAPILimiter - limiter configured by API_RPS (default 5, 0 disables limiting) and API_BURST (default API_RPS),
+// adapting to API_SLOW_LATENCY (default 5s) and API_MAX_ERROR_RATE (default 0.2), nil when disabled
+func newAPILimiter() *apiLimiter {
+	rate := getAPIFloat("API_RPS", 5)
+	if rate == 0 {
+		return nil
+	}
+	burst := getAPIFloat("API_BURST", rate)
+	if burst < 1 {
+		burst = 1
+	}
+	return &apiLimiter{
+		mtx:     &sync.Mutex{},
+		maxRate: rate,
+		rate:    rate,
+		burst:   burst,
+		tokens:  burst,
+		last:    time.Now(),
+		slow:    getAPIDuration("API_SLOW_LATENCY", 5*time.Second),
+		maxErrs: getAPIFloat("API_MAX_ERROR_RATE", 0.2),
+		lowest:  rate,
+	}
+}
+
+// wait - wait for a token, returns ctx error when cancelled while waiting
+func (l *apiLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mtx.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mtx.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mtx.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// observe - record latency and result of a call (failed: network error, 5xx or 429) and adapt the rate
+// averages are exponentially weighted, so they follow about last 10 calls
+func (l *apiLimiter) observe(latency time.Duration, failed bool) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	const alpha = 0.2
+	l.latency = time.Duration((1-alpha)*float64(l.latency) + alpha*float64(latency))
+	e := 0.0
+	if failed {
+		e = 1.0
+	}
+	l.errRate = (1-alpha)*l.errRate + alpha*e
+	l.calls++
+	if l.latency > l.slow || l.errRate > l.maxErrs {
+		if l.calls < 5 {
+			return
+		}
+		l.calls = 0
+		rate := l.rate / 2
+		if rate < l.maxRate/100 {
+			rate = l.maxRate / 100
+		}
+		if rate < l.rate {
+			fmt.Printf("API latency %v, error rate %.2f: slowing down to %.3g calls/s\n", l.latency, l.errRate, rate)
+			l.rate = rate
+		}
+		if l.rate < l.lowest {
+			l.lowest = l.rate
+		}
+		return
+	}
+	if l.rate < l.maxRate {
+		l.rate += l.maxRate / 20
+		if l.rate >= l.maxRate {
+			l.rate = l.maxRate
+			fmt.Printf("API latency and error rate back to normal, rate restored to %.3g calls/s\n", l.rate)
+		}
+	}
+}
+
+// String - current and configured rates
+func (l *apiLimiter) String() string {
+	if l == nil {
+		return "unlimited"
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	s := fmt.Sprintf("%.3g calls/s, burst %.3g", l.maxRate, l.burst)
+	if l.lowest < l.maxRate {
+		s += fmt.Sprintf(", slowed down to %.3g calls/s at most, now %.3g calls/s", l.lowest, l.rate)
+	}
+	return s
+}
+
+// affsClient - affiliation API client: base URL, token source and HTTP client with timeouts
+// and keep-alive connections pool sized to the number of workers calling it
+type affsClient struct {
+	baseURL string
+	tokens  tokenSource
+	client  *http.Client
+	retries int
+	maxWait time.Duration
+	limiter *apiLimiter
+	stats   apiStats
+}
+
+// getAPIDuration - get API client related duration from environment, dflt if not set
+func getAPIDuration(env string, dflt time.Duration) time.Duration {
+	s := os.Getenv(env)
+	if s == "" {
+		return dflt
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Panicf("invalid %s value: '%s', expected Go duration like 30s or 1m", env, s)
+	}
+	return d
+}
+
+// newAffsClient - API client for baseURL, nConns is the number of workers making concurrent calls
+// API_TIMEOUT limits the whole request (default 60s), API_CONNECT_TIMEOUT connecting and TLS handshake (default 10s)
+func newAffsClient(baseURL string, tokens tokenSource, nConns int) *affsClient {
+	if nConns < 1 {
+		nConns = 1
+	}
+	connectTimeout := getAPIDuration("API_CONNECT_TIMEOUT", 10*time.Second)
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          nConns,
+		MaxIdleConnsPerHost:   nConns,
+		MaxConnsPerHost:       nConns,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &affsClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		tokens:  tokens,
+		client:  &http.Client{Transport: transport, Timeout: getAPIDuration("API_TIMEOUT", 60*time.Second)},
+		retries: getAPIRetries(),
+		maxWait: getAPIDuration("API_RETRY_MAX_WAIT", 5*time.Minute),
+		limiter: newAPILimiter(),
+		stats:   apiStats{mtx: &sync.Mutex{}, retries: map[string]int{}},
+	}
+}
+
+// apiError - non-200 API response, permanent for 4xx statuses other than 429 (retrying cannot help)
+type apiError struct {
+	method    string
+	path      string
+	status    int
+	body      []byte
+	permanent bool
+	retried   bool
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("method:%s url:%s status:%d\n%s", e.method, e.path, e.status, e.body)
+}
+
+// isPermanentAPIError - did the call fail permanently? other failures are transient (given up after retries)
+func isPermanentAPIError(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.permanent
+}
+
+// isRetriedAPIError - did a retried call fail permanently? an earlier attempt could have succeeded
+// without its response being received, so the caller must check whether the change was done
+func isRetriedAPIError(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.permanent && e.retried
+}
+
+// apiStats - API calls made and their retries and failures
+type apiStats struct {
+	mtx       *sync.Mutex
+	calls     int
+	retries   map[string]int
+	permanent int
+	transient int
+}
+
+// getAPIRetries - maximum number of retries of a failed API call from API_RETRIES, default 5
+func getAPIRetries() int {
+	s := os.Getenv("API_RETRIES")
+	if s == "" {
+		return 5
+	}
+	retries, err := strconv.Atoi(s)
+	if err != nil || retries < 0 {
+		log.Panicf("invalid API_RETRIES value: '%s'", s)
+	}
+	return retries
+}
+
+// apiBackoff - jittered exponential backoff before attempt-th retry: random value from [d/2, d)
+// where d is 500ms doubled with each attempt, up to 30s
+func apiBackoff(attempt int) time.Duration {
+	d := 500 * time.Millisecond
+	for i := 1; i < attempt && d < 30*time.Second; i++ {
+		d *= 2
+	}
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// retryAfter - delay requested by Retry-After header (seconds or HTTP date), 0 if none
+func retryAfter(resp *http.Response) time.Duration {
+	s := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if s == "" {
+		return 0
+	}
+	secs, err := strconv.Atoi(s)
+	if err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0
+	}
+	d := time.Until(t)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// retryReason - why the call with response resp (nil on transport error) can be retried, "" if it cannot
+// calls which are not idempotent are only retried when the API refused them (429) as they could be processed otherwise
+func (c *affsClient) retryReason(ctx context.Context, resp *http.Response, idempotent bool) string {
+	if resp == nil {
+		if ctx.Err() != nil || !idempotent {
+			return ""
+		}
+		return "network error"
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "429"
+	case resp.StatusCode >= 500 && idempotent:
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// countCall - record result of an API call: reason of a retry or err of the final attempt
+func (c *affsClient) countCall(reason string, err error) {
+	c.stats.mtx.Lock()
+	defer c.stats.mtx.Unlock()
+	if reason != "" {
+		c.stats.retries[reason]++
+		return
+	}
+	c.stats.calls++
+	if err == nil {
+		return
+	}
+	if isPermanentAPIError(err) {
+		c.stats.permanent++
+	} else {
+		c.stats.transient++
+	}
+}
+
+// printStats - display API calls summary, failures are split into permanent (4xx) and transient ones
+func (c *affsClient) printStats() {
+	c.stats.mtx.Lock()
+	defer c.stats.mtx.Unlock()
+	if c.stats.calls == 0 {
+		return
+	}
+	fmt.Printf("API calls: %d, failed permanently (4xx): %d, failed transiently (given up): %d\n", c.stats.calls, c.stats.permanent, c.stats.transient)
+	fmt.Printf("API rate limit: %s\n", c.limiter)
+	if len(c.stats.retries) > 0 {
+		fmt.Printf("API retries: %+v\n", c.stats.retries)
+	}
+}
+
+// do - call API method on path with optional JSON body, decodes JSON response to out (if not nil)
+// the token is refreshed once when the API rejects it, nothing is called in dry-run mode
+// transient failures (network errors, 5xx for idempotent calls, 429) are retried up to API_RETRIES times
+// with jittered exponential backoff, waiting at least as long as Retry-After header asks for
+func (c *affsClient) do(ctx context.Context, method, path string, idempotent bool, body, out interface{}) (err error) {
+	if gDry {
+		if gDebug {
+			fmt.Printf("dry-run API call: %s '%s'\n", method, path)
+		}
+		return
+	}
+	if c.baseURL == "" {
+		err = fmt.Errorf("Cannot execute DA affiliation API calls, no API URL specified")
+		return
+	}
+	var payload []byte
+	if body != nil {
+		payload, err = jsoniter.Marshal(body)
+		if err != nil {
+			return
+		}
+	}
+	token, err := c.tokens.token(ctx)
+	if err != nil {
+		// the run was cancelled while waiting for the token, it is not a token failure
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		err = fmt.Errorf("%w: %v", errAPIToken, err)
+		abortRun(err)
+		return
+	}
+	refreshed := false
+	for attempt := 1; ; attempt++ {
+		var (
+			reader io.Reader
+			resp   *http.Response
+			data   []byte
+		)
+		if payload != nil {
+			reader = bytes.NewReader(payload)
+		}
+		req, e := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+		if e != nil {
+			err = fmt.Errorf("new request error: %+v for %s url: %s", e, method, path)
+			return
+		}
+		req.Header.Set("Authorization", token)
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		err = c.limiter.wait(ctx)
+		if err != nil {
+			c.countCall("", err)
+			return
+		}
+		start := time.Now()
+		resp, e = c.client.Do(req)
+		c.limiter.observe(time.Since(start), e != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests)
+		if e != nil {
+			err = fmt.Errorf("do request error: %+v for %s url: %s", e, method, path)
+			resp = nil
+		} else {
+			data, e = ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if !refreshed && resp.StatusCode == http.StatusUnauthorized {
+				refreshed = true
+				token, err = c.tokens.refresh(ctx, token)
+				if err != nil {
+					if ctx.Err() != nil {
+						err = ctx.Err()
+						return
+					}
+					err = fmt.Errorf("%w: %v", errAPIToken, err)
+					abortRun(err)
+					return
+				}
+				attempt--
+				continue
+			}
+			switch {
+			case e != nil:
+				err = fmt.Errorf("readAll request error: %+v for %s url: %s", e, method, path)
+			case resp.StatusCode != http.StatusOK:
+				err = &apiError{
+					method:    method,
+					path:      path,
+					status:    resp.StatusCode,
+					body:      data,
+					permanent: resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests,
+					retried:   attempt > 1,
+				}
+			case out != nil:
+				err = jsoniter.Unmarshal(data, out)
+				if err != nil {
+					err = fmt.Errorf("unmarshal response error: %+v for %s url: %s", err, method, path)
+				}
+			default:
+				err = nil
+			}
+		}
+		reason := ""
+		if err != nil {
+			reason = c.retryReason(ctx, resp, idempotent)
+		}
+		if reason == "" || attempt > c.retries {
+			if reason != "" {
+				err = fmt.Errorf("giving up after %d retries: %w", c.retries, err)
+			}
+			c.countCall("", err)
+			return
+		}
+		c.countCall(reason, nil)
+		backoff := apiBackoff(attempt)
+		if resp != nil {
+			wait := retryAfter(resp)
+			if wait > c.maxWait {
+				err = fmt.Errorf("Retry-After %v is longer than API_RETRY_MAX_WAIT %v: %w", wait, c.maxWait, err)
+				c.countCall("", err)
+				return
+			}
+			if wait > backoff {
+				backoff = wait
+			}
+		}
+		if gDebug {
+			fmt.Printf("%s %s: %s, retry #%d in %v\n", method, path, reason, attempt, backoff)
+		}
+		select {
+		case <-ctx.Done():
+			c.countCall("", err)
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// mergeUniqueIdentitiesPath - API path merging unique identity fromUUID into toUUID
+func mergeUniqueIdentitiesPath(fromUUID, toUUID string, archive bool) string {
+	return "/v1/affiliation/no-project/merge_unique_identities/" + url.PathEscape(fromUUID) + "/" + url.PathEscape(toUUID) + "?archive=" + strconv.FormatBool(archive)
+}
+
+// mergeUniqueIdentities - merge unique identity fromUUID into toUUID, archive keeps the merged one for unmerge
+// it is retried as idempotent: repeating a merge that was already done fails permanently (4xx) and changes nothing,
+// callers use mergeDone when a retried call fails permanently to find out whether an earlier attempt merged
+func (c *affsClient) mergeUniqueIdentities(ctx context.Context, fromUUID, toUUID string, archive bool) error {
+	return c.do(ctx, http.MethodPut, mergeUniqueIdentitiesPath(fromUUID, toUUID, archive), true, nil, nil)
+}
+
+// mergeDone - is identity id in unique identity toUUID on the primary? checked when a retried merge failed permanently,
+// err is returned unchanged unless the merge was done by an earlier attempt
+func mergeDone(ctx context.Context, db *sqlx.DB, id, toUUID string, err error) error {
+	if !isRetriedAPIError(err) {
+		return err
+	}
+	row, e := rowValues(ctx, db, nil, "identities", "id = ?", id)
+	if e != nil {
+		fmt.Printf("checking retried merge of identity %s into %s: %+v\n", id, toUUID, e)
+		return err
+	}
+	if row == nil || row["uuid"] != toUUID {
+		return err
+	}
+	fmt.Printf("identity %s is in unique identity %s, retried merge failed after an earlier attempt merged: %v\n", id, toUUID, err)
+	return nil
+}
+
+// orphanKind - kind of orphaned rows: rows of table matching where, deleted by their keyCol
+type orphanKind struct {
+	table  string
+	keyCol string
+	where  string
+	reason string
+}
+
+// orphanedUIdentities - unique identities without identities
+const orphanedUIdentities = "select u.uuid from uidentities u where not exists (select 1 from identities i where i.uuid = u.uuid)"
+
+// orphanKinds - kinds of orphaned rows in FK dependency order (rows referencing unique identities are deleted before them),
+// profiles and enrollments of unique identities without identities are deleted explicitly, so they are backed up
+var orphanKinds = []orphanKind{
+	{table: "enrollments", keyCol: "id", where: "uuid is null or uuid not in (select uuid from uidentities)", reason: "orphaned_enrollment"},
+	{table: "profiles", keyCol: "uuid", where: "uuid not in (select uuid from uidentities)", reason: "orphaned_profile"},
+	{table: "identities", keyCol: "id", where: "uuid is null or uuid not in (select uuid from uidentities)", reason: "orphaned_identity"},
+	{table: "enrollments", keyCol: "id", where: "uuid in (" + orphanedUIdentities + ")", reason: reasonOrphaned},
+	{table: "profiles", keyCol: "uuid", where: "uuid in (" + orphanedUIdentities + ")", reason: reasonOrphaned},
+	{table: "uidentities", keyCol: "uuid", where: "not exists (select 1 from identities i where i.uuid = uidentities.uuid)", reason: reasonOrphaned},
+}
+
+// orphanKindsOf - kinds of orphaned rows deleted for reason, in FK dependency order
+func orphanKindsOf(reason string) (kinds []orphanKind) {
+	for _, kind := range orphanKinds {
+		if kind.reason == reason {
+			kinds = append(kinds, kind)
+		}
+	}
+	return
+}
+
+// findOrphanKind - kind of orphaned rows of table deleted for reason
+func findOrphanKind(table, reason string) (kind orphanKind, ok bool) {
+	for _, kind = range orphanKinds {
+		if kind.table == table && kind.reason == reason {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// orphansScope - scope condition for orphans of table, uuids apply to all tables, modification date only to tables having it
+func orphansScope(table string) (where string, args []interface{}) {
+	conds := []string{}
+	if len(gScope.uuids) > 0 {
+		conds = append(conds, "uuid in "+placeholders(len(gScope.uuids)))
+		args = append(args, strArgs(gScope.uuids)...)
+	}
+	if gScope.modifiedAfter != "" && (table == "identities" || table == "uidentities") {
+		conds = append(conds, "last_modified > ?")
+		args = append(args, gScope.modifiedAfter)
+	}
+	where = andWhere(conds...)
+	return
+}
+
+// countRows - number of table rows matching where
+func countRows(ctx context.Context, db *sqlx.DB, table, where string, args ...interface{}) (n int, err error) {
+	rows, err := query(ctx, db, nil, "select count(*) from "+table+" where "+where, args...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		err = rows.Scan(&n)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// orphansMetric - circuit breaker metric counting deleted orphans of table, empty if not counted
+func orphansMetric(table string) string {
+	return map[string]string{"identities": breakIdentities, "uidentities": breakUIdentities}[table]
+}
+
+// checkOrphansBreaker - count orphans of kinds having a circuit breaker metric before anything is deleted,
+// returns reasons whose rows must not be deleted: rows referencing unique identities without identities
+// are deleted for the same reason as the unique identities, so they are kept when those would exceed a threshold
+func checkOrphansBreaker(ctx context.Context, db *sqlx.DB, kinds []orphanKind) (blocked map[string]bool, err error) {
+	blocked = make(map[string]bool)
+	for _, kind := range kinds {
+		metric := orphansMetric(kind.table)
+		if metric == "" {
+			continue
+		}
+		scopeWhere, scopeArgs := orphansScope(kind.table)
+		var n, scanned int
+		n, err = countRows(ctx, readDB(db), kind.table, andWhere(kind.where, scopeWhere), scopeArgs...)
+		if err != nil || n == 0 {
+			if err != nil {
+				return
+			}
+			continue
+		}
+		// all rows of the table in scope are checked, so they count as scanned
+		scanned, err = countRows(ctx, readDB(db), kind.table, andWhere("1 = 1", scopeWhere), scopeArgs...)
+		if err != nil {
+			return
+		}
+		gBreaker.scan(scanned, metric)
+		// only checked here, each page reserves its rows when it is deleted
+		if !gBreaker.allow(metric, n) {
+			blocked[kind.reason] = true
+			continue
+		}
+		gBreaker.settle(metric, n, 0)
+	}
+	return
+}
+
+// deleteOrphans - delete orphaned rows of kind in pages of BATCH_SIZE read by key, returns number of rows found and deleted
+// each page is reported, then re-read on the primary in its transaction (it is listed from the read endpoint),
+// backed up and deleted by keys and kind's condition, so only backed up rows can be deleted
+func deleteOrphans(ctx context.Context, db *sqlx.DB, kind orphanKind, report func(orphanKind, []map[string]interface{})) (found, deleted int64, err error) {
+	scopeWhere, scopeArgs := orphansScope(kind.table)
+	metric := orphansMetric(kind.table)
+	batch := getBatchSize()
+	var last interface{}
+	for {
+		if isStopping() {
+			unprocessed("orphaned %s (%s): rows after key %v not deleted", kind.table, kind.reason, last)
+			return
+		}
+		where, args := andWhere(kind.where, scopeWhere), scopeArgs
+		if last != nil {
+			where = andWhere(where, kind.keyCol+" > ?")
+			args = append(append([]interface{}{}, scopeArgs...), last)
+		}
+		var orphans []map[string]interface{}
+		orphans, err = selectRows(ctx, readDB(db), nil, kind.table, where+" order by "+kind.keyCol+" limit "+strconv.Itoa(batch), args...)
+		if err != nil || len(orphans) == 0 {
+			return
+		}
+		last = orphans[len(orphans)-1][kind.keyCol]
+		found += int64(len(orphans))
+		report(kind, orphans)
+		if metric != "" && !gBreaker.allow(metric, len(orphans)) {
+			unprocessed("orphaned %s (%s): rows from key %v not deleted, circuit breaker tripped", kind.table, kind.reason, orphans[0][kind.keyCol])
+			return
+		}
+		if gDry {
+			for _, orphan := range orphans {
+				err = planAdd(planEntry{Op: "delete_orphan", Table: kind.table, Key: fmt.Sprintf("%v", orphan[kind.keyCol]), Reason: kind.reason})
+				if err != nil {
+					return
+				}
+			}
+			deleted += int64(len(orphans))
+			continue
+		}
+		keys := []interface{}{}
+		for _, orphan := range orphans {
+			keys = append(keys, orphan[kind.keyCol])
+		}
+		cond := andWhere(kind.keyCol+" in "+placeholders(len(keys)), kind.where)
+		var n int64
+		err = retryTX(
+			ctx,
+			"delete orphaned "+kind.table,
+			func() (err error) {
+				tx, err := beginTX(ctx, db)
+				if err != nil {
+					return
+				}
+				defer func() {
+					if err != nil {
+						rollbackTX(tx)
+						return
+					}
+					err = commitTX(tx)
+				}()
+				rows, err := selectRows(ctx, db, tx, kind.table, cond, keys...)
+				if err != nil || len(rows) == 0 {
+					return
+				}
+				err = backup(tx, "delete", kind.table, kind.keyCol, "", rows)
+				if err != nil {
+					return
+				}
+				records := []auditRecord{}
+				for _, row := range rows {
+					records = append(records, auditRecord{op: "delete", table: kind.table, key: fmt.Sprintf("%v", row[kind.keyCol]), oldValue: rowJSON(row), reason: kind.reason})
+				}
+				err = audit(ctx, db, tx, records)
+				if err != nil {
+					return
+				}
+				res, err := exec(ctx, db, tx, "delete from "+kind.table+" where "+cond, keys...)
+				if err != nil {
+					return
+				}
+				n, _ = res.RowsAffected()
+				return
+			},
+		)
+		if metric != "" {
+			gBreaker.settle(metric, len(orphans), int(n))
+		}
+		if err != nil {
+			return
+		}
+		deleted += n
+	}
+}
+
+// cleanupOrphans - list orphaned rows of kinds (to ORPHANS_FILE, default orphans.json, one JSON object per line),
+// then delete them kind by kind and report per-table counts
+func cleanupOrphans(ctx context.Context, db *sqlx.DB, kinds []orphanKind) (err error) {
+	fn := os.Getenv("ORPHANS_FILE")
+	if fn == "" {
+		fn = "orphans.json"
+	}
+	file, err := os.Create(fn)
+	if err != nil {
+		return
+	}
+	defer func() { _ = file.Close() }()
+	var reportErr error
+	report := func(kind orphanKind, rows []map[string]interface{}) {
+		for _, row := range rows {
+			data, e := jsoniter.Marshal(map[string]interface{}{"table": kind.table, "reason": kind.reason, "row": row})
+			if e == nil {
+				_, e = file.Write(append(data, '\n'))
+			}
+			if e != nil && reportErr == nil {
+				reportErr = e
+			}
+		}
+	}
+	blocked, err := checkOrphansBreaker(ctx, db, kinds)
+	if err != nil {
+		return
+	}
+	tables := []string{}
+	found, deleted := map[string]int64{}, map[string]int64{}
+	for _, kind := range kinds {
+		if blocked[kind.reason] {
+			unprocessed("orphaned %s (%s): not deleted, circuit breaker tripped", kind.table, kind.reason)
+			continue
+		}
+		if isStopping() {
+			unprocessed("orphaned %s (%s): not started", kind.table, kind.reason)
+			continue
+		}
+		_, ok := found[kind.table]
+		if !ok {
+			tables = append(tables, kind.table)
+		}
+		f, d, e := deleteOrphans(ctx, db, kind, report)
+		fmt.Printf("orphaned %s (%s): %d\n", kind.table, kind.reason, f)
+		found[kind.table] += f
+		deleted[kind.table] += d
+		if e != nil {
+			err = fmt.Errorf("deleting orphaned %s (%s): %w", kind.table, kind.reason, e)
+			break
+		}
+	}
+	if reportErr == nil {
+		fmt.Printf("orphaned rows listed in %s\n", fn)
+	} else if err == nil {
+		err = reportErr
+	}
+	for _, table := range tables {
+		fmt.Printf("orphans: %s: found:%d, deleted:%d\n", table, found[table], deleted[table])
+	}
+	return
+}
+
+// restoreBackup - replay before-images from backup of run RESTORE
+// RESTORE_TABLES and RESTORE_KEYS (comma separated) can be used to restore only a subset of rows
+// records are replayed from the newest to the oldest, so each row ends up in its state from before the run
+func restoreBackup(ctx context.Context, db *sqlx.DB) (err error) {
+	runID := os.Getenv("RESTORE")
+	fn := backupFileName(runID)
+	filter := func(env string) (m map[string]struct{}) {
+		str := os.Getenv(env)
+		if str == "" {
+			return
+		}
+		m = make(map[string]struct{})
+		for _, item := range strings.Split(str, ",") {
+			m[strings.TrimSpace(item)] = struct{}{}
+		}
+		return
+	}
+	tables := filter("RESTORE_TABLES")
+	keys := filter("RESTORE_KEYS")
+	file, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer func() { _ = file.Close() }()
+	json := jsoniter.Config{UseNumber: true}.Froze()
+	records := []backupRecord{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var record backupRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return
+		}
+		if record.RunID != runID {
+			continue
+		}
+		if tables != nil {
+			_, ok := tables[record.Table]
+			if !ok {
+				continue
+			}
+		}
+		if keys != nil {
+			_, ok := keys[record.Key]
+			if !ok {
+				continue
+			}
+		}
+		records = append(records, record)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+	fmt.Printf("restoring %d rows from %s\n", len(records), fn)
+	restored := 0
+	restoreRecord := func(record backupRecord) (err error) {
+		tx, err := beginTX(ctx, db)
+		if err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				rollbackTX(tx)
+				return
+			}
+			err = commitTX(tx)
+		}()
+		if record.NewKey != "" && record.NewKey != record.Key {
+			_, err = exec(ctx, db, tx, "delete from "+record.Table+" where "+record.KeyCol+" = ?", record.NewKey)
+			if err != nil {
+				return
+			}
+		}
+		columns := []string{}
+		for column := range record.Row {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		args := []interface{}{}
+		for _, column := range columns {
+			args = append(args, record.Row[column])
+		}
+		_, err = exec(ctx, db, tx, gDialect.upsert(record.Table, record.KeyCol, columns), args...)
+		if err != nil {
+			return
+		}
+		err = audit(ctx, db, tx, []auditRecord{{op: "restore", table: record.Table, key: record.Key, newValue: rowJSON(record.Row), reason: reasonRestore}})
+		return
+	}
+	errs := []error{}
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if isStopping() {
+			unprocessed("restore: %d oldest backup records, up to %s %s=%s", i+1, record.Table, record.KeyCol, record.Key)
+			break
+		}
+		e := retryTX(ctx, "restore "+record.Table+" "+record.Key, func() error { return restoreRecord(record) })
+		if e != nil {
+			fmt.Printf("restore error for %s %s=%s: %+v\n", record.Table, record.KeyCol, record.Key, e)
+			errs = append(errs, e)
+			continue
+		}
+		if gDebug {
+			fmt.Printf("restored %s %s=%s (%s)\n", record.Table, record.KeyCol, record.Key, record.Op)
+		}
+		restored++
+	}
+	fmt.Printf("restored %d/%d rows\n", restored, len(records))
+	nErrs := len(errs)
+	if nErrs > 0 {
+		err = fmt.Errorf("%d errors: %+v", nErrs, errs)
+	}
+	return
+}
+
+func cleanupProfiles(ctx context.Context, db *sqlx.DB, api *affsClient) (err error) {
+	var (
+		id       string
+		uuid     *string
+		source   string
+		name     *string
+		username *string
+		email    *string
+		page     []profileIdentity
+		mtx      *sync.Mutex
+	)
+	if api.baseURL == "" {
+		err = fmt.Errorf("API_URL must be set")
+		return
+	}
+	resume := resumeCheckpoint("cleanup_profiles")
+	if resume != nil && resume.Phase == "done" {
+		fmt.Printf("cleanup_profiles: already completed by run %s\n", gRunID)
+		return
+	}
+	inc, err := startIncremental(ctx, db, "cleanup_profiles")
+	if err != nil {
+		return
+	}
+	if inc != nil {
+		inc.NewUIdentities = ""
+	}
+	merges, permanent, transient := 0, 0, 0
+	phase, startKey := "identities", ""
+	if resume != nil {
+		phase, startKey, merges = resume.Phase, resume.Key, resume.Counters["merges"]
+		fmt.Printf("cleanup_profiles: resuming %s from key '%s'\n", phase, startKey)
+	}
+	counters := func() map[string]int {
+		if mtx != nil {
+			mtx.Lock()
+			defer mtx.Unlock()
+		}
+		return map[string]int{"merges": merges}
+	}
+	cp := newCheckpointer("cleanup_profiles", phase, inc)
+	getKey := func(source string, username, email *string) (key string) {
+		key = source
+		if username != nil && *username != "" {
+			key += ":" + *username
+		}
+		if email != nil && *email != "" {
+			key += ":" + *email
+		}
+		return
+	}
+	// mergeTargets - identities with empty name (and a unique identity) having the same source, username and email
+	// as identities of the page, looked up in batches of BATCH_SIZE, the first one by id is used for each key
+	mergeTargets := func(page []profileIdentity) (targets map[string]profileIdentity, err error) {
+		targets = make(map[string]profileIdentity)
+		value := func(s *string) string {
+			if s == nil {
+				return ""
+			}
+			return *s
+		}
+		batch := getBatchSize()
+		for from := 0; from < len(page); from += batch {
+			to := from + batch
+			if to > len(page) {
+				to = len(page)
+			}
+			conds, args := []string{}, []interface{}{}
+			for _, identity := range page[from:to] {
+				conds = append(conds, "source = ? and coalesce(username, '') = ? and coalesce(email, '') = ?")
+				args = append(args, identity.source, value(identity.username), value(identity.email))
+			}
+			var rows *sql.Rows
+			rows, err = query(
+				ctx,
+				readDB(db),
+				nil,
+				"select id, uuid, source, username, email from identities where "+
+					andWhere("name is null or trim(name) = ''", "uuid is not null", strings.Join(conds, ") or ("))+" order by id",
+				args...,
+			)
+			if err != nil {
+				return
+			}
+			for rows.Next() {
+				var target profileIdentity
+				err = rows.Scan(&target.id, &target.uuid, &target.source, &target.username, &target.email)
+				if err != nil {
+					_ = rows.Close()
+					return
+				}
+				key := getKey(target.source, target.username, target.email)
+				_, dup := targets[key]
+				if dup {
+					fmt.Printf("empty names: non-unique key: %s\n", key)
+					// We merge into first found
+					continue
+				}
+				targets[key] = target
+			}
+			err = rows.Err()
+			_ = rows.Close()
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	processIdentity := func(ch chan error, i int, identity profileIdentity, target profileIdentity) (err error) {
+		defer func() {
+			if ch != nil {
+				ch <- err
+			}
+		}()
+		if target.uuid == nil {
+			return
+		}
+		uuid2 := *target.uuid
+		puuid := identity.uuid
+		if puuid == nil {
+			return
+		}
+		uuid := *puuid
+		if uuid == uuid2 {
+			return
+		}
+		id, id2 := identity.id, target.id
 		if id != uuid {
 			fmt.Printf("complex #%d (%s,%s) -> (%s,%s)\n", i, id, uuid, id2, uuid2)
 		}
-		fmt.Printf("merge #%d %s -> %s\n", i, uuid, uuid2)
-		// curl_put_merge_unique_identities.sh 'odpi/egeria' 16fe424acecf8d614d102fc0ece919a22200481d aaa8024197795de9b90676592772633c5cfcb35a "$ar1"
-		err = executeAffiliationsAPICall(apiPath, "/v1/affiliation/no-project/merge_unique_identities/"+uuid+"/"+uuid2+"?archive=true")
+		fmt.Printf("merge #%d %s -> %s\n", i, uuid, uuid2)
+		// curl_put_merge_unique_identities.sh 'odpi/egeria' 16fe424acecf8d614d102fc0ece919a22200481d aaa8024197795de9b90676592772633c5cfcb35a "$ar1"
+		err = planAdd(
+			planEntry{
+				Op:     "merge",
+				Table:  "uidentities",
+				Key:    id,
+				Path:   mergeUniqueIdentitiesPath(uuid, uuid2, true),
+				Reason: reasonMissingName,
+				Before: map[string]string{"uuid": uuid},
+				After:  map[string]string{"uuid": uuid2},
+			},
+		)
+		if err != nil {
+			return
+		}
+		if gReadDB != nil {
+			// identity was read from the read endpoint, make sure the primary still has it in the same unique identity
+			var row map[string]string
+			row, err = rowValues(ctx, db, nil, "identities", "id = ?", id)
+			if err != nil {
+				return
+			}
+			if row == nil || row["uuid"] != uuid {
+				fmt.Printf("skipping merge #%d %s -> %s: identity %s changed on primary\n", i, uuid, uuid2, id)
+				return
+			}
+		}
+		if gBreaker.isTripped() || !gBreaker.allow(breakMerges, 1) {
+			unprocessed("merge #%d %s -> %s: circuit breaker tripped", i, uuid, uuid2)
+			err = fmt.Errorf("merge #%d %s -> %s not made: %w", i, uuid, uuid2, errTripped)
+			return
+		}
+		merged := 0
+		defer func() {
+			gBreaker.settle(breakMerges, 1, merged)
+		}()
+		err = mergeDone(ctx, db, id, uuid2, api.mergeUniqueIdentities(ctx, uuid, uuid2, true))
+		if err != nil {
+			fmt.Printf("merge error: %+v\n", err)
+			if errors.Is(err, errAPIToken) {
+				unprocessed("merge #%d %s -> %s: no API token", i, uuid, uuid2)
+				return
+			}
+			if mtx != nil {
+				mtx.Lock()
+			}
+			if isPermanentAPIError(err) {
+				permanent++
+			} else {
+				transient++
+			}
+			if mtx != nil {
+				mtx.Unlock()
+			}
+			if ctx.Err() != nil {
+				unprocessed("merge #%d %s -> %s: cancelled", i, uuid, uuid2)
+			}
+			return
+		}
+		fmt.Printf("merged #%d %s -> %s\n", i, uuid, uuid2)
+		merged = 1
+		err = audit(ctx, db, nil, []auditRecord{{op: "merge", table: "uidentities", key: uuid, column: "uuid", oldValue: uuid, newValue: uuid2, reason: reasonMissingName}})
+		if err != nil {
+			return
+		}
+		if mtx != nil {
+			mtx.Lock()
+		}
+		merges++
+		if mtx != nil {
+			mtx.Unlock()
+		}
+		return
+	}
+	errs := []error{}
+	if phase == "identities" {
+		// identities to merge into are looked up for each page, they are counted here for the summary
+		var empty int
+		empty, err = countRows(
+			ctx,
+			readDB(db),
+			"identities",
+			"(name is null or trim(name) = '') and ((username is not null and trim(username) != '') or (email is not null and trim(email) != ''))",
+		)
+		if err != nil {
+			return
+		}
+		fmt.Printf("%d identities with empty/null name and non-empty username or email\n", empty)
+		var missingMap map[string]struct{}
+		if gDebug {
+			missingMap = make(map[string]struct{})
+		}
+		thrN := getThreadsNum()
+		fmt.Printf("Using %d threads\n", thrN)
+		if thrN > 0 {
+			mtx = &sync.Mutex{}
+		}
+		pool := newWorkerPool(thrN)
+		i := 0
+		// scope and incremental mode limit identities to process, identities to merge into are looked up in all rows
+		scopeWhere, scopeArgs := gScope.identitiesWhere()
+		incWhere, incArgs := inc.identitiesWhere()
+		scopeWhere, scopeArgs = andWhere(scopeWhere, incWhere), append(scopeArgs, incArgs...)
+		lastKey := startKey
+		if startKey != "" {
+			scopeWhere, scopeArgs = andWhere(scopeWhere, "id > ?"), append(scopeArgs, startKey)
+		}
+		n, e := scanPages(
+			ctx,
+			db,
+			"id, uuid, source, name, username, email",
+			"identities",
+			"id",
+			andWhere("name like '%%-MISSING-NAME' and ((username is not null and trim(username) != '') or (email is not null and trim(email) != ''))", scopeWhere),
+			scopeArgs,
+			func(rows *sql.Rows) (string, error) {
+				err := rows.Scan(&id, &uuid, &source, &name, &username, &email)
+				if err != nil {
+					return "", err
+				}
+				if gDebug {
+					key := getKey(source, username, email)
+					_, dup := missingMap[key]
+					if dup {
+						fmt.Printf("missing names: non-unique key: %s\n", key)
+					}
+					missingMap[key] = struct{}{}
+				}
+				// log.Println(id, uuid, source, name, username, email)
+				page = append(page, profileIdentity{id: id, uuid: uuid, source: source, name: name, username: username, email: email})
+				return id, nil
+			},
+			func() error {
+				gBreaker.scan(len(page), breakMerges)
+				targets, err := mergeTargets(page)
+				if err != nil {
+					return err
+				}
+				for _, identity := range page {
+					if isStopping() {
+						unprocessed("identities (profiles cleanup): rows with id >= '%s' with missing name suffix", identity.id)
+						page = nil
+						return errStopped
+					}
+					identity, idx := identity, i
+					target := targets[getKey(identity.source, identity.username, identity.email)]
+					pool.run(
+						func(ch chan error) error {
+							return processIdentity(ch, idx, identity, target)
+						},
+					)
+					lastKey = identity.id
+					i++
+				}
+				page = nil
+				if cp.due() {
+					cp.save(lastKey, counters(), pool.wait())
+				}
+				return nil
+			},
+		)
+		errs = append(errs, pool.wait()...)
+		if e != nil {
+			err = e
+			return
+		}
+		fmt.Printf("%d identities with missing name suffix and non-empty username or email\n", n)
+		if isStopping() {
+			cp.save(lastKey, counters(), errs)
+		} else {
+			cp.next("orphans", counters(), errs)
+		}
+	}
+	if merges > 0 {
+		fmt.Printf("merged %d profiles\n", merges)
+	}
+	if permanent > 0 || transient > 0 {
+		fmt.Printf("merge failures: permanent (4xx): %d, transient (given up after retries): %d\n", permanent, transient)
+	}
+	if os.Getenv("DELETE_ORPHANED") != "" && isStopping() {
+		unprocessed("orphaned uidentities deletion: not started")
+	} else if os.Getenv("DELETE_ORPHANED") != "" {
+		e := cleanupOrphans(ctx, db, orphanKindsOf(reasonOrphaned))
+		if e != nil {
+			errs = append(errs, e)
+		}
+	}
+	nErrs := len(errs)
+	if nErrs > 0 {
+		err = fmt.Errorf("%d errors: %+v", nErrs, errs)
+		return
+	}
+	err = inc.save(ctx, db)
+	if err != nil || isStopping() {
+		return
+	}
+	cp.next("done", counters(), nil)
+	return
+}
+
+// dryRunState - simulated effects of changes skipped in dry-run mode, so read-only prechecks
+// of later changes see them exactly like a real run would see applied changes
+type dryRunState struct {
+	mtx        *sync.Mutex
+	identities map[string]bool
+	profiles   map[string]string
+}
+
+// gDryState - identity ID -> does it exist after simulated changes, profile uuid -> its simulated email
+var gDryState = &dryRunState{mtx: &sync.Mutex{}, identities: map[string]bool{}, profiles: map[string]string{}}
+
+// errDryRunDuplicate - simulated duplicate-key error for a batch in dry-run mode
+var errDryRunDuplicate = errors.New("dry-run: Duplicate entry")
+
+// identityExists - does identity exist, taking simulated changes into account, must be called with mtx locked
+func (s *dryRunState) identityExists(ctx context.Context, db *sqlx.DB, id string) (exists bool, err error) {
+	exists, ok := s.identities[id]
+	if ok {
+		return
+	}
+	rows, err := query(ctx, readDB(db), nil, "select 1 from identities where id = ?", id)
+	if err != nil {
+		return
+	}
+	exists = rows.Next()
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// profileEmail - profile email, taking simulated changes into account, must be called with mtx locked
+func (s *dryRunState) profileEmail(ctx context.Context, db *sqlx.DB, uuid string) (email string, found bool, err error) {
+	email, found = s.profiles[uuid]
+	if found {
+		return
+	}
+	rows, err := query(ctx, readDB(db), nil, "select coalesce(email, '') from profiles where uuid = ?", uuid)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		err = rows.Scan(&email)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		found = true
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// simulatedProfileEmail - profile email changed by a simulated change, if any
+func (s *dryRunState) simulatedProfileEmail(uuid string) (email string, ok bool) {
+	s.mtx.Lock()
+	email, ok = s.profiles[uuid]
+	s.mtx.Unlock()
+	return
+}
+
+// rewriteIdentity - simulate rewriteIdentityEmail (update, or delete when the new ID already exists, then profile update)
+// must be called with mtx locked
+func (s *dryRunState) rewriteIdentity(ctx context.Context, db *sqlx.DB, c identityChange, updateProfile bool) (del bool, affected, pAffected int64, err error) {
+	id, uuid, uidentity, currEmail, email := c.id, c.uuid, c.uidentity, c.currEmail, c.email
+	exists, err := s.identityExists(ctx, db, id)
+	if err != nil || !exists {
+		return
+	}
+	if uuid != id {
+		var dup bool
+		dup, err = s.identityExists(ctx, db, uuid)
+		if err != nil {
+			return
+		}
+		del = dup
+		s.identities[id] = false
+		if !del {
+			s.identities[uuid] = true
+		}
+	}
+	affected = 1
+	// new identity ID is computed from all these columns, apply must refuse the entry when any of them changed
+	before := map[string]string{"email": currEmail, "source": c.source, "name": c.name, "username": c.username, "uuid": uidentity}
+	if del {
+		err = planAdd(planEntry{Op: "delete_identity", Table: "identities", Key: id, NewKey: uuid, Reason: reasonDuplicate, Before: before})
+		if err != nil {
+			return
+		}
+	} else {
+		err = planAdd(
+			planEntry{
+				Op:     "update_identity",
+				Table:  "identities",
+				Key:    id,
+				NewKey: uuid,
+				Reason: emailReason(email),
+				Before: before,
+				After:  map[string]string{"id": uuid, "email": email},
+			},
+		)
+		if err != nil {
+			return
+		}
+	}
+	if !updateProfile || uidentity == "" {
+		return
+	}
+	pEmail, found, err := s.profileEmail(ctx, db, uidentity)
+	if err != nil || !found || pEmail != currEmail {
+		return
+	}
+	s.profiles[uidentity] = email
+	pAffected = 1
+	err = planAdd(
+		planEntry{
+			Op:     "update_profile",
+			Table:  "profiles",
+			Key:    uidentity,
+			Reason: reasonIdentityEmail,
+			Before: map[string]string{"email": pEmail},
+			After:  map[string]string{"email": email},
+		},
+	)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// dryRewriteIdentityEmail - dry-run version of rewriteIdentityEmail, uses read-only prechecks only
+func dryRewriteIdentityEmail(ctx context.Context, db *sqlx.DB, c identityChange, updateProfile bool) (del bool, affected, pAffected int64, err error) {
+	gDryState.mtx.Lock()
+	defer gDryState.mtx.Unlock()
+	return gDryState.rewriteIdentity(ctx, db, c, updateProfile)
+}
+
+// dryWriteIdentityBatch - dry-run version of writeIdentityBatch, uses read-only prechecks only
+// returns errDryRunDuplicate when a real batch update would hit a duplicate-key conflict
+func dryWriteIdentityBatch(ctx context.Context, db *sqlx.DB, changes []identityChange, updateProfile bool) (found map[string]int64, err error) {
+	gDryState.mtx.Lock()
+	defer gDryState.mtx.Unlock()
+	newIDs := make(map[string]struct{})
+	for _, c := range changes {
+		if c.uuid == c.id {
+			continue
+		}
+		_, dup := newIDs[c.uuid]
+		if !dup {
+			dup, err = gDryState.identityExists(ctx, db, c.uuid)
+			if err != nil {
+				return
+			}
+		}
+		if dup {
+			err = errDryRunDuplicate
+			return
+		}
+		newIDs[c.uuid] = struct{}{}
+	}
+	found = make(map[string]int64)
+	for _, c := range changes {
+		var affected, pAffected int64
+		_, affected, pAffected, err = gDryState.rewriteIdentity(ctx, db, c, updateProfile)
+		if err != nil {
+			found = nil
+			return
+		}
+		if affected > 0 {
+			found[c.id] = pAffected
+		}
+	}
+	return
+}
+
+// dryWriteProfileBatch - dry-run version of writeProfileBatch, uses read-only prechecks only
+func dryWriteProfileBatch(ctx context.Context, db *sqlx.DB, changes []profileChange) (found map[string]struct{}, err error) {
+	gDryState.mtx.Lock()
+	defer gDryState.mtx.Unlock()
+	found = make(map[string]struct{})
+	for _, c := range changes {
+		var (
+			ok     bool
+			pEmail string
+		)
+		pEmail, ok, err = gDryState.profileEmail(ctx, db, c.uuid)
+		if err != nil {
+			found = nil
+			return
+		}
+		if ok {
+			found[c.uuid] = struct{}{}
+			gDryState.profiles[c.uuid] = c.email
+			err = planAdd(
+				planEntry{
+					Op:     "update_profile",
+					Table:  "profiles",
+					Key:    c.uuid,
+					Reason: emailReason(c.email),
+					Before: map[string]string{"email": pEmail},
+					After:  map[string]string{"email": c.email},
+				},
+			)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// planVersion - version of the plan file format, 2: identity entries have all columns new identity ID depends on as preconditions
+const planVersion = 2
+
+// planHeader - first line of a plan file
+type planHeader struct {
+	Version   int       `json:"version"`
+	RunID     string    `json:"run_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// planEntry - single change recorded by a plan, Before values are preconditions checked on apply
+// Op is one of: merge, update_identity, delete_identity, update_profile, delete_orphan
+// Path is API call made by merges, for review only: apply merges Before uuid into After uuid
+type planEntry struct {
+	Seq    int               `json:"seq"`
+	Op     string            `json:"op"`
+	Table  string            `json:"table"`
+	Key    string            `json:"key"`
+	NewKey string            `json:"new_key,omitempty"`
+	Path   string            `json:"path,omitempty"`
+	Reason string            `json:"reason,omitempty"`
+	Before map[string]string `json:"before,omitempty"`
+	After  map[string]string `json:"after,omitempty"`
+}
+
+// planWriter - writes plan entries to a plan file
+type planWriter struct {
+	mtx  *sync.Mutex
+	file *os.File
+	fn   string
+	seq  int
+}
+
+// newPlanWriter - create plan file and write its header
+func newPlanWriter(fn string) (w *planWriter, err error) {
+	file, err := os.Create(fn)
+	if err != nil {
+		return
+	}
+	data, err := jsoniter.Marshal(planHeader{Version: planVersion, RunID: gRunID, CreatedAt: time.Now()})
+	if err != nil {
+		_ = file.Close()
+		return
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		_ = file.Close()
+		return
+	}
+	w = &planWriter{mtx: &sync.Mutex{}, file: file, fn: fn}
+	return
+}
+
+// planAdd - record a change in the plan, does nothing when not planning
+func planAdd(entry planEntry) (err error) {
+	if gPlan == nil {
+		return
+	}
+	gPlan.mtx.Lock()
+	defer gPlan.mtx.Unlock()
+	gPlan.seq++
+	entry.Seq = gPlan.seq
+	data, err := jsoniter.Marshal(entry)
+	if err == nil {
+		_, err = gPlan.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		err = fmt.Errorf("%w %s: %v", errPlanWrite, gPlan.fn, err)
+		abortRun(err)
+	}
+	return
+}
+
+// closePlan - close plan file
+func closePlan() {
+	if gPlan == nil {
+		return
+	}
+	gPlan.mtx.Lock()
+	defer gPlan.mtx.Unlock()
+	err := gPlan.file.Close()
+	if err != nil {
+		fmt.Printf("close plan file error: %+v\n", err)
+	}
+	if gBreaker.isTripped() {
+		// plan of an aborted run must not be applied, it is kept for review only
+		err = os.Rename(gPlan.fn, gPlan.fn+".tripped")
+		if err != nil {
+			fmt.Printf("cannot rename plan file of aborted run: %+v\n", err)
+		}
+		fmt.Printf("run aborted by circuit breaker, incomplete plan with %d entries saved to %s.tripped\n", gPlan.seq, gPlan.fn)
+		return
+	}
+	fmt.Printf("plan with %d entries saved to %s\n", gPlan.seq, gPlan.fn)
+}
+
+// rowValues - select a single row's columns as strings (NULL is returned as empty string)
+func rowValues(ctx context.Context, db *sqlx.DB, tx *sql.Tx, table, where string, args ...interface{}) (values map[string]string, err error) {
+	rows, err := selectRows(ctx, db, tx, table, where, args...)
+	if err != nil || len(rows) == 0 {
+		return
+	}
+	values = make(map[string]string)
+	for column, value := range rows[0] {
+		if value != nil {
+			values[column] = fmt.Sprintf("%v", value)
+		} else {
+			values[column] = ""
+		}
+	}
+	return
+}
+
+// errPlanChanged - plan entry precondition does not hold anymore
+var errPlanChanged = errors.New("row changed since the plan was made")
+
+// applyPlanEntry - re-check plan entry preconditions and apply it in a transaction
+// returns errPlanChanged (wrapped) when the rows were modified since the plan was made
+func applyPlanEntry(ctx context.Context, db *sqlx.DB, api *affsClient, entry planEntry) (err error) {
+	changed := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: "+format, append([]interface{}{errPlanChanged}, args...)...)
+	}
+	if entry.Reason == "" {
+		entry.Reason = "plan"
+	}
+	if entry.Op == "merge" {
+		var row map[string]string
+		row, err = rowValues(ctx, db, nil, "identities", "id = ?", entry.Key)
+		if err != nil {
+			return
+		}
+		if row == nil || row["uuid"] != entry.Before["uuid"] {
+			return changed("identity %s is not in unique identity %s anymore", entry.Key, entry.Before["uuid"])
+		}
+		row, err = rowValues(ctx, db, nil, "uidentities", "uuid = ?", entry.After["uuid"])
+		if err != nil {
+			return
+		}
+		if row == nil {
+			return changed("unique identity %s does not exist anymore", entry.After["uuid"])
+		}
+		err = mergeDone(ctx, db, entry.Key, entry.After["uuid"], api.mergeUniqueIdentities(ctx, entry.Before["uuid"], entry.After["uuid"], true))
+		if err != nil {
+			return
+		}
+		return audit(
+			ctx,
+			db,
+			nil,
+			[]auditRecord{{op: "merge", table: "uidentities", key: entry.Before["uuid"], column: "uuid", oldValue: entry.Before["uuid"], newValue: entry.After["uuid"], reason: entry.Reason}},
+		)
+	}
+	tx, err := beginTX(ctx, db)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			rollbackTX(tx)
+			return
+		}
+		err = commitTX(tx)
+	}()
+	var row map[string]string
+	keyCol := "uuid"
+	if entry.Table == "identities" || entry.Table == "enrollments" {
+		keyCol = "id"
+	}
+	row, err = rowValues(ctx, db, tx, entry.Table, keyCol+" = ?", entry.Key)
+	if err != nil {
+		return
+	}
+	if row == nil {
+		return changed("%s %s does not exist anymore", entry.Table, entry.Key)
+	}
+	for column, value := range entry.Before {
+		if row[column] != value {
+			return changed("%s %s %s is '%s', was '%s'", entry.Table, entry.Key, column, row[column], value)
+		}
+	}
+	switch entry.Op {
+	case "update_identity", "delete_identity":
+		exists := false
+		if entry.NewKey != entry.Key {
+			var newRow map[string]string
+			newRow, err = rowValues(ctx, db, tx, "identities", "id = ?", entry.NewKey)
+			if err != nil {
+				return
+			}
+			exists = newRow != nil
+		}
+		if entry.Op == "update_identity" && exists {
+			return changed("identity %s already exists", entry.NewKey)
+		}
+		if entry.Op == "delete_identity" && !exists {
+			return changed("identity %s does not exist anymore", entry.NewKey)
+		}
+		if entry.Op == "delete_identity" {
+			err = backupRows(ctx, db, tx, "delete", "identities", "id", "", "id = ?", entry.Key)
+			if err != nil {
+				return
+			}
+			_, err = exec(ctx, db, tx, "delete from identities where id = ?", entry.Key)
+			if err != nil {
+				return
+			}
+			err = audit(ctx, db, tx, []auditRecord{{op: "delete", table: "identities", key: entry.Key, oldValue: rowJSON(row), reason: entry.Reason}})
+			return
+		}
+		err = backupRows(ctx, db, tx, "update", "identities", "id", entry.NewKey, "id = ?", entry.Key)
+		if err != nil {
+			return
+		}
+		_, err = exec(ctx, db, tx, "update identities set email = ?, id = ? where id = ?", entry.After["email"], entry.NewKey, entry.Key)
+		if err != nil {
+			return
+		}
+		records := identityAudit(nil, entry.Key, entry.NewKey, row["email"], entry.After["email"], false)
+		for i := range records {
+			records[i].reason = entry.Reason
+		}
+		err = audit(ctx, db, tx, records)
+	case "update_profile":
+		err = backupRows(ctx, db, tx, "update", "profiles", "uuid", "", "uuid = ?", entry.Key)
+		if err != nil {
+			return
+		}
+		_, err = exec(ctx, db, tx, "update profiles set email = ? where uuid = ?", entry.After["email"], entry.Key)
+		if err != nil {
+			return
+		}
+		err = audit(
+			ctx,
+			db,
+			tx,
+			[]auditRecord{{op: "update", table: "profiles", key: entry.Key, column: "email", oldValue: row["email"], newValue: entry.After["email"], reason: entry.Reason}},
+		)
+	case "delete_orphan":
+		kind, ok := findOrphanKind(entry.Table, entry.Reason)
+		if !ok {
+			err = fmt.Errorf("unknown orphaned rows kind: %s %s", entry.Table, entry.Reason)
+			return
+		}
+		cond := andWhere(kind.keyCol+" = ?", kind.where)
+		var orphan map[string]string
+		orphan, err = rowValues(ctx, db, tx, kind.table, cond, entry.Key)
+		if err != nil {
+			return
+		}
+		if orphan == nil {
+			return changed("%s %s is not orphaned anymore", entry.Table, entry.Key)
+		}
+		err = backupRows(ctx, db, tx, "delete", kind.table, kind.keyCol, "", cond, entry.Key)
+		if err != nil {
+			return
+		}
+		_, err = exec(ctx, db, tx, "delete from "+kind.table+" where "+cond, entry.Key)
+		if err != nil {
+			return
+		}
+		err = audit(ctx, db, tx, []auditRecord{{op: "delete", table: kind.table, key: entry.Key, oldValue: rowJSON(row), reason: entry.Reason}})
+	default:
+		err = fmt.Errorf("unknown plan entry operation: '%s'", entry.Op)
+	}
+	return
+}
+
+// planMetric - circuit breaker metric of a plan entry, "" if it has none
+func planMetric(entry planEntry) string {
+	switch entry.Op {
+	case "merge":
+		return breakMerges
+	case "delete_identity":
+		return breakIdentities
+	case "update_identity", "update_profile":
+		if entry.After["email"] == "" {
+			return breakBlanked
+		}
+	case "delete_orphan":
+		return map[string]string{"identities": breakIdentities, "uidentities": breakUIdentities}[entry.Table]
+	}
+	return ""
+}
+
+// checkPlanBreaker - refuse to apply a plan crossing absolute circuit breaker thresholds, nothing is applied then
+// scanned rows are not known when applying, percentage thresholds are enforced by the run making the plan
+// returns changes of each metric reserved for the plan
+func checkPlanBreaker(fn string) (reserved map[string]int, err error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	counts := map[string]int{}
+	for header := true; scanner.Scan(); header = false {
+		if header {
+			continue
+		}
+		var entry planEntry
+		err = jsoniter.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return
+		}
+		metric := planMetric(entry)
+		if metric != "" {
+			counts[metric]++
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+	reserved = map[string]int{}
+	for metric, n := range counts {
+		if !gBreaker.allow(metric, n) {
+			for metric, n := range reserved {
+				gBreaker.settle(metric, n, 0)
+			}
+			reserved = nil
+			err = fmt.Errorf("plan %s has %d %s changes, crossing circuit breaker threshold", fn, n, metric)
+			return
+		}
+		reserved[metric] = n
+	}
+	return
+}
+
+// applyPlan - execute plan saved in APPLY file, entries are applied in order
+// entries whose rows were changed since the plan was made are refused
+func applyPlan(ctx context.Context, db *sqlx.DB, api *affsClient) (err error) {
+	fn := os.Getenv("APPLY")
+	file, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	if !scanner.Scan() {
+		err = scanner.Err()
+		if err == nil {
+			err = fmt.Errorf("empty plan file %s", fn)
+		}
+		return
+	}
+	var header planHeader
+	err = jsoniter.Unmarshal(scanner.Bytes(), &header)
+	if err != nil {
+		return
+	}
+	if header.Version != planVersion {
+		err = fmt.Errorf("plan %s has version %d, only version %d is supported", fn, header.Version, planVersion)
+		return
+	}
+	reserved, err := checkPlanBreaker(fn)
+	if err != nil {
+		return
+	}
+	// changes reserved for entries refused, failed or not reached are released
+	made := map[string]int{}
+	defer func() {
+		for metric, n := range reserved {
+			gBreaker.settle(metric, n, made[metric])
+		}
+	}()
+	fmt.Printf("applying plan %s made by run %s at %v\n", fn, header.RunID, header.CreatedAt)
+	applied, refused := 0, 0
+	errs := []error{}
+	for scanner.Scan() {
+		var entry planEntry
+		err = jsoniter.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return
+		}
+		if isStopping() {
+			unprocessed("plan %s: entries from #%d", fn, entry.Seq)
+			break
+		}
+		e := retryTX(ctx, fmt.Sprintf("plan entry #%d", entry.Seq), func() error { return applyPlanEntry(ctx, db, api, entry) })
+		if errors.Is(e, errPlanChanged) {
+			fmt.Printf("refusing #%d %s %s: %v\n", entry.Seq, entry.Op, entry.Key, e)
+			refused++
+			continue
+		}
+		if e != nil {
+			fmt.Printf("error applying #%d %s %s: %+v\n", entry.Seq, entry.Op, entry.Key, e)
+			errs = append(errs, e)
+			continue
+		}
+		if gDebug {
+			fmt.Printf("applied #%d %s %s\n", entry.Seq, entry.Op, entry.Key)
+		}
+		applied++
+		metric := planMetric(entry)
+		if metric != "" {
+			made[metric]++
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+	fmt.Printf("plan: applied:%d, refused:%d, failed:%d\n", applied, refused, len(errs))
+	nErrs := len(errs)
+	if nErrs > 0 {
+		err = fmt.Errorf("%d errors: %+v", nErrs, errs)
+	}
+	return
+}
+
+// auditRecord - single change saved to cleanup_audit table: one record per changed column,
+// deleted rows have empty column and their full before-image (JSON) as old value
+type auditRecord struct {
+	op       string
+	table    string
+	key      string
+	column   string
+	oldValue string
+	newValue string
+	reason   string
+}
+
+// Audit reason codes
+const (
+	reasonInvalidEmail    = "invalid_email"
+	reasonNormalizedEmail = "normalized_email"
+	reasonDuplicate       = "duplicate_identity"
+	reasonIdentityEmail   = "identity_email_changed"
+	reasonOrphaned        = "orphaned_uidentity"
+	reasonMissingName     = "missing_name_duplicate"
+	reasonRestore         = "restore"
+)
+
+// emailReason - audit reason code of an email change to email
+func emailReason(email string) string {
+	if email == "" {
+		return reasonInvalidEmail
+	}
+	return reasonNormalizedEmail
+}
+
+// getOperator - person running the cleanup: OPERATOR or OS user@host
+func getOperator() string {
+	operator := os.Getenv("OPERATOR")
+	if operator != "" {
+		return operator
+	}
+	host, userName := runLockOwner()
+	return userName + "@" + host
+}
+
+// initAudit - create audit table if it does not exist
+func initAudit(ctx context.Context, db *sqlx.DB) error {
+	return retryTX(
+		ctx,
+		"audit table",
+		func() (err error) {
+			_, err = execDB(
+				ctx,
+				db,
+				"create table if not exists cleanup_audit(run_id varchar(64) not null, operation varchar(32) not null, table_name varchar(64) not null, "+
+					"row_key varchar(255) not null, column_name varchar(64) not null, old_value text, new_value text, reason varchar(64) not null, "+
+					"operator varchar(255) not null, created_at datetime(6) not null)",
+				false,
+			)
+			return
+		},
+	)
+}
+
+// rowJSON - row as JSON, used as audit value of inserted and deleted rows
+func rowJSON(row interface{}) string {
+	data, err := jsoniter.Marshal(row)
+	if err != nil {
+		return fmt.Sprintf("%v", row)
+	}
+	return string(data)
+}
+
+// audit - save audit records in transaction tx (or autocommit when tx is nil), so they are committed together with the changes
+func audit(ctx context.Context, db *sqlx.DB, tx *sql.Tx, records []auditRecord) (err error) {
+	now := time.Now().UTC()
+	batch := 1000
+	for from := 0; from < len(records); from += batch {
+		to := from + batch
+		if to > len(records) {
+			to = len(records)
+		}
+		args := []interface{}{}
+		for _, r := range records[from:to] {
+			args = append(args, gRunID, r.op, r.table, r.key, r.column, r.oldValue, r.newValue, r.reason, gOperator, now)
+		}
+		_, err = exec(
+			ctx,
+			db,
+			tx,
+			"insert into cleanup_audit(run_id, operation, table_name, row_key, column_name, old_value, new_value, reason, operator, created_at) values"+
+				strings.TrimPrefix(strings.Repeat(", (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", to-from), ","),
+			args...,
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// identityAudit - audit records of identity email (and ID) rewrite, del means the identity was deleted
+func identityAudit(row map[string]interface{}, id, uuid, currEmail, email string, del bool) []auditRecord {
+	if del {
+		return []auditRecord{{op: "delete", table: "identities", key: id, oldValue: rowJSON(row), reason: reasonDuplicate}}
+	}
+	reason := emailReason(email)
+	records := []auditRecord{{op: "update", table: "identities", key: id, column: "email", oldValue: currEmail, newValue: email, reason: reason}}
+	if uuid != id {
+		records = append(records, auditRecord{op: "update", table: "identities", key: id, column: "id", oldValue: id, newValue: uuid, reason: reason})
+	}
+	return records
+}
+
+// rewriteIdentityEmail - set identity's new email and ID in a single transaction
+// when identity with the new ID already exists current identity is deleted instead
+// when updateProfile is set, profile email of the identity's unique identity is updated too
+// (only if it is the same as identity's old email), any error rolls back all changes
+func rewriteIdentityEmail(ctx context.Context, db *sqlx.DB, c identityChange, updateProfile bool) (del bool, affected, pAffected int64, err error) {
+	if gDry {
+		return dryRewriteIdentityEmail(ctx, db, c, updateProfile)
+	}
+	id, uuid, uidentity, currEmail, email := c.id, c.uuid, c.uidentity, c.currEmail, c.email
+	var (
+		tx  *sql.Tx
+		res sql.Result
+	)
+	tx, err = beginTX(ctx, db)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			rollbackTX(tx)
+			return
+		}
+		err = commitTX(tx)
+	}()
+	// before-images are saved before the transaction is committed, we only know
+	// if this will be an update or a delete after trying the update
+	// the row is locked, so it cannot change between this check and the update
+	before, err := selectRows(ctx, db, tx, "identities", "id = ?"+gDialect.forUpdate(), id)
+	if err != nil {
+		return
+	}
+	// identity's email could have changed since it was read (possibly from the read endpoint)
+	if len(before) == 0 || fmt.Sprintf("%v", before[0]["email"]) != currEmail {
+		return
+	}
+	res, err = execQuiet(ctx, db, tx, "update identities set email = ?, id = ? where id = ? and email = ?", email, uuid, id, currEmail)
+	if err != nil {
+		if !isDuplicateKeyError(err) {
+			return
+		}
+		res, err = exec(ctx, db, tx, "delete from identities where id = ? and email = ?", id, currEmail)
 		if err != nil {
-			fmt.Printf("merge error: %+v\n", err)
 			return
 		}
-		fmt.Printf("merged #%d %s -> %s\n", i, uuid, uuid2)
-		if mtx != nil {
-			mtx.Lock()
+		del = true
+	}
+	affected, _ = res.RowsAffected()
+	if affected == 0 {
+		return
+	}
+	if del {
+		err = backup(tx, "delete", "identities", "id", "", before)
+	} else {
+		err = backup(tx, "update", "identities", "id", uuid, before)
+	}
+	if err != nil {
+		return
+	}
+	err = audit(ctx, db, tx, identityAudit(before[0], id, uuid, currEmail, email, del))
+	if err != nil {
+		return
+	}
+	if !updateProfile || uidentity == "" {
+		return
+	}
+	err = backupRows(ctx, db, tx, "update", "profiles", "uuid", "", "uuid = ? and email = ?", uidentity, currEmail)
+	if err != nil {
+		return
+	}
+	res, err = exec(ctx, db, tx, "update profiles set email = ? where uuid = ? and email = ?", email, uidentity, currEmail)
+	if err != nil {
+		return
+	}
+	pAffected, _ = res.RowsAffected()
+	if pAffected == 0 {
+		return
+	}
+	err = audit(ctx, db, tx, []auditRecord{{op: "update", table: "profiles", key: uidentity, column: "email", oldValue: currEmail, newValue: email, reason: reasonIdentityEmail}})
+	return
+}
+
+// writeIdentityBatch - rewrite emails and IDs of a batch of identities in a single transaction
+// uses one multi-row update for identities and one for their profiles (if updateProfile is set)
+// returns IDs of identities that were found (mapped to the number of their profiles updated),
+// any error rolls back the whole batch, duplicate-key error means the batch must be processed row by row
+func writeIdentityBatch(ctx context.Context, db *sqlx.DB, changes []identityChange, updateProfile bool) (found map[string]int64, err error) {
+	if gDry {
+		return dryWriteIdentityBatch(ctx, db, changes, updateProfile)
+	}
+	var tx *sql.Tx
+	tx, err = beginTX(ctx, db)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			rollbackTX(tx)
+			found = nil
+			return
 		}
-		merges++
-		if mtx != nil {
-			mtx.Unlock()
+		err = commitTX(tx)
+	}()
+	ids := []interface{}{}
+	for _, c := range changes {
+		ids = append(ids, c.id)
+	}
+	found = make(map[string]int64)
+	rows, err := selectRows(ctx, db, tx, "identities", "id in (?"+strings.Repeat(",?", len(ids)-1)+")"+gDialect.forUpdate(), ids...)
+	if err != nil {
+		return
+	}
+	// only identities whose email is still the one read (possibly from the read endpoint) are updated,
+	// the rows are locked and the update checks their emails again
+	emails := make(map[string]string)
+	for _, row := range rows {
+		emails[fmt.Sprintf("%v", row["id"])] = fmt.Sprintf("%v", row["email"])
+	}
+	ids = []interface{}{}
+	emailCase, idCase, currCase := []interface{}{}, []interface{}{}, []interface{}{}
+	newIDs, newEmails := make(map[string]string), make(map[string]string)
+	for _, c := range changes {
+		currEmail, ok := emails[c.id]
+		if !ok || currEmail != c.currEmail {
+			continue
+		}
+		ids = append(ids, c.id)
+		emailCase = append(emailCase, c.id, c.email)
+		idCase = append(idCase, c.id, c.uuid)
+		currCase = append(currCase, c.id, c.currEmail)
+		newIDs[c.id] = c.uuid
+		newEmails[c.id] = c.email
+	}
+	if len(ids) == 0 {
+		return
+	}
+	in := "(?" + strings.Repeat(",?", len(ids)-1) + ")"
+	before := []map[string]interface{}{}
+	for _, row := range rows {
+		_, ok := newIDs[fmt.Sprintf("%v", row["id"])]
+		if ok {
+			before = append(before, row)
+		}
+	}
+	whens := strings.Repeat(" when ? then ?", len(ids))
+	args := append(append(append(append([]interface{}{}, emailCase...), idCase...), ids...), currCase...)
+	res, err := execQuiet(ctx, db, tx, "update identities set email = case id"+whens+" end, id = case id"+whens+" end where id in "+in+" and email = case id"+whens+" end", args...)
+	if err != nil {
+		return
+	}
+	affected, _ := res.RowsAffected()
+	if affected != int64(len(ids)) {
+		err = fmt.Errorf("batch of %d identities: %d updated, rows changed concurrently", len(ids), affected)
+		return
+	}
+	// before-images are saved only after the update succeeded, batch with a duplicate-key
+	// conflict is rolled back and its rows are backed up again by the row by row fallback
+	records := []auditRecord{}
+	for _, row := range before {
+		id := fmt.Sprintf("%v", row["id"])
+		err = backup(tx, "update", "identities", "id", newIDs[id], []map[string]interface{}{row})
+		if err != nil {
+			return
+		}
+		found[id] = 0
+		records = append(records, identityAudit(row, id, newIDs[id], emails[id], newEmails[id], false)...)
+	}
+	err = audit(ctx, db, tx, records)
+	if err != nil {
+		return
+	}
+	if !updateProfile {
+		return
+	}
+	// each profile is updated only when its email is the same as identity's old email
+	conds, whereArgs, emailWhens := []string{}, []interface{}{}, []interface{}{}
+	pairs := make(map[[2]string]string)
+	for _, c := range changes {
+		_, ok := found[c.id]
+		if c.uidentity == "" || !ok {
+			continue
+		}
+		pair := [2]string{c.uidentity, c.currEmail}
+		_, dup := pairs[pair]
+		if dup {
+			continue
 		}
+		pairs[pair] = c.id
+		conds = append(conds, "(uuid = ? and email = ?)")
+		whereArgs = append(whereArgs, c.uidentity, c.currEmail)
+		emailWhens = append(emailWhens, c.uidentity, c.currEmail, c.email)
+	}
+	if len(conds) == 0 {
+		return
+	}
+	where := strings.Join(conds, " or ")
+	profiles, err := selectRows(ctx, db, tx, "profiles", where, whereArgs...)
+	if err != nil {
+		return
+	}
+	err = backup(tx, "update", "profiles", "uuid", "", profiles)
+	if err != nil {
 		return
 	}
-	rows, err = query(
+	records = []auditRecord{}
+	for _, row := range profiles {
+		uuid, email := fmt.Sprintf("%v", row["uuid"]), fmt.Sprintf("%v", row["email"])
+		id := pairs[[2]string{uuid, email}]
+		found[id]++
+		records = append(records, auditRecord{op: "update", table: "profiles", key: uuid, column: "email", oldValue: email, newValue: newEmails[id], reason: reasonIdentityEmail})
+	}
+	_, err = exec(
+		ctx,
 		db,
-		nil,
-		"select id, uuid, source, name, username, email from identities where name like '%%-MISSING-NAME' "+
-			"and ((username is not null and trim(username) != '') or (email is not null and trim(email) != ''))",
+		tx,
+		"update profiles set email = case"+strings.Repeat(" when uuid = ? and email = ? then ?", len(conds))+" else email end where "+where,
+		append(emailWhens, whereArgs...)...,
 	)
 	if err != nil {
 		return
 	}
-	var missingMap map[string]struct{}
-	if gDebug {
-		missingMap = make(map[string]struct{})
+	err = audit(ctx, db, tx, records)
+	return
+}
+
+// writeProfileBatch - update emails of a batch of profiles in a single transaction, using one multi-row update
+// returns uuids of profiles that were found
+func writeProfileBatch(ctx context.Context, db *sqlx.DB, changes []profileChange) (found map[string]struct{}, err error) {
+	if gDry {
+		return dryWriteProfileBatch(ctx, db, changes)
+	}
+	var tx *sql.Tx
+	tx, err = beginTX(ctx, db)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			rollbackTX(tx)
+			found = nil
+			return
+		}
+		err = commitTX(tx)
+	}()
+	uuids := []interface{}{}
+	currEmails := make(map[string]string)
+	for _, c := range changes {
+		uuids = append(uuids, c.uuid)
+		currEmails[c.uuid] = c.currEmail
+	}
+	found = make(map[string]struct{})
+	rows, err := selectRows(ctx, db, tx, "profiles", "uuid in (?"+strings.Repeat(",?", len(uuids)-1)+")"+gDialect.forUpdate(), uuids...)
+	if err != nil {
+		return
+	}
+	// only profiles whose email is still the one read (possibly from the read endpoint) are updated
+	before := []map[string]interface{}{}
+	for _, row := range rows {
+		uuid := fmt.Sprintf("%v", row["uuid"])
+		if fmt.Sprintf("%v", row["email"]) == currEmails[uuid] {
+			before = append(before, row)
+			found[uuid] = struct{}{}
+		}
+	}
+	if len(before) == 0 {
+		return
+	}
+	err = backup(tx, "update", "profiles", "uuid", "", before)
+	if err != nil {
+		return
+	}
+	uuids, emailCase, currCase := []interface{}{}, []interface{}{}, []interface{}{}
+	records := []auditRecord{}
+	for _, c := range changes {
+		_, ok := found[c.uuid]
+		if ok {
+			uuids = append(uuids, c.uuid)
+			emailCase = append(emailCase, c.uuid, c.email)
+			currCase = append(currCase, c.uuid, c.currEmail)
+			records = append(records, auditRecord{op: "update", table: "profiles", key: c.uuid, column: "email", oldValue: c.currEmail, newValue: c.email, reason: emailReason(c.email)})
+		}
+	}
+	in := "(?" + strings.Repeat(",?", len(uuids)-1) + ")"
+	whens := strings.Repeat(" when ? then ?", len(uuids))
+	res, err := exec(
+		ctx,
+		db,
+		tx,
+		"update profiles set email = case uuid"+whens+" end where uuid in "+in+" and email = case uuid"+whens+" end",
+		append(append(emailCase, uuids...), currCase...)...,
+	)
+	if err != nil {
+		return
+	}
+	affected, _ := res.RowsAffected()
+	if affected != int64(len(uuids)) {
+		err = fmt.Errorf("batch of %d profiles: %d updated, rows changed concurrently", len(uuids), affected)
+		return
 	}
+	err = audit(ctx, db, tx, records)
+	return
+}
+
+func cleanupEmails(ctx context.Context, db *sqlx.DB) (err error) {
 	thrN := getThreadsNum()
 	fmt.Printf("Using %d threads\n", thrN)
-	for rows.Next() {
-		err = rows.Scan(&id, &uuid, &source, &name, &username, &email)
+	var (
+		id       string
+		uuid     string
+		source   string
+		name     string
+		username string
+		email    string
+		page     []emailIdentity
+		mtx      *sync.Mutex
+	)
+	if thrN > 0 {
+		mtx = &sync.Mutex{}
+	}
+	validateDomain := os.Getenv("SKIP_VALIDATE_DOMAIN") == ""
+	guess := os.Getenv("SKIP_GUESS_EMAIL") == ""
+	skipIdentities := os.Getenv("SKIP_IDENTITIES") != ""
+	skipProfiles := os.Getenv("SKIP_PROFILES") != ""
+	batchSize := getBatchSize()
+	resume := resumeCheckpoint("cleanup_emails")
+	if resume != nil && resume.Phase == "done" {
+		fmt.Printf("cleanup_emails: already completed by run %s\n", gRunID)
+		return
+	}
+	inc, err := startIncremental(ctx, db, "cleanup_emails")
+	if err != nil {
+		return
+	}
+	if inc != nil && skipIdentities {
+		inc.NewIdentities = ""
+	}
+	if inc != nil && skipProfiles {
+		inc.NewUIdentities = ""
+	}
+	scopeWhere, scopeArgs := gScope.identitiesWhere()
+	incWhere, incArgs := inc.identitiesWhere()
+	scopeWhere, scopeArgs = andWhere(scopeWhere, incWhere), append(scopeArgs, incArgs...)
+	profilesWhere, profilesArgs := gScope.profilesWhere()
+	incWhere, incArgs = inc.profilesWhere()
+	profilesWhere, profilesArgs = andWhere(profilesWhere, incWhere), append(profilesArgs, incArgs...)
+	cleanups, changes, deleted, mismatch, quarantined, iprofiles, fallbacks := 0, 0, 0, 0, 0, 0, 0
+	pcleanups, pchanges := 0, 0
+	phase, startKey := "identities", ""
+	if resume != nil {
+		phase, startKey = resume.Phase, resume.Key
+		c := resume.Counters
+		cleanups, changes, deleted, mismatch, quarantined = c["cleanups"], c["changes"], c["deleted"], c["mismatch"], c["quarantined"]
+		iprofiles, fallbacks, pcleanups, pchanges = c["iprofiles"], c["fallbacks"], c["pcleanups"], c["pchanges"]
+		fmt.Printf("cleanup_emails: resuming %s from key '%s'\n", phase, startKey)
+	}
+	counters := func() map[string]int {
+		if mtx != nil {
+			mtx.Lock()
+			defer mtx.Unlock()
+		}
+		return map[string]int{
+			"cleanups":    cleanups,
+			"changes":     changes,
+			"deleted":     deleted,
+			"mismatch":    mismatch,
+			"quarantined": quarantined,
+			"iprofiles":   iprofiles,
+			"fallbacks":   fallbacks,
+			"pcleanups":   pcleanups,
+			"pchanges":    pchanges,
+		}
+	}
+	cp := newCheckpointer("cleanup_emails", phase, inc)
+	errs := []error{}
+	quarantineIdentity := func(id, source, name, username, currEmail, email string, e error) {
+		quarantine(
+			quarantineItem{
+				Table:    "identities",
+				ID:       id,
+				Source:   source,
+				Name:     name,
+				Username: username,
+				Email:    currEmail,
+				NewEmail: email,
+				Reason:   e.Error(),
+			},
+		)
+		if mtx != nil {
+			mtx.Lock()
+		}
+		quarantined++
+		if mtx != nil {
+			mtx.Unlock()
+		}
+	}
+	// recordIdentity - report identity change, returns number of emails it blanked (identity's and its profile's)
+	recordIdentity := func(c identityChange, del bool, affected, pAffected int64) (blanked int) {
+		if del {
+			fmt.Printf("correct identity already exists #%d (src=%s,name=%s,uname=%s,email=%s->%s), deleted current %s\n", c.i, c.source, c.name, c.username, c.currEmail, c.email, c.id)
+		}
+		if affected == 0 {
+			fmt.Printf("no rows affected for (%s->%s,src=%s,email=%s->%s,name=%s,uname=%s)\n", c.id, c.uuid, c.source, c.currEmail, c.email, c.name, c.username)
+			return
+		}
+		// if gDebug {
+		fmt.Printf("processed #%d identity (valid=%v,del=%v,%d,%d,%s->%s,src=%s,email=%s->%s,name=%s,uname=%s)\n", c.i, c.valid, del, affected, pAffected, c.id, c.uuid, c.source, c.currEmail, c.email, c.name, c.username)
+		// }
+		if mtx != nil {
+			mtx.Lock()
+		}
+		if pAffected != 0 {
+			iprofiles++
+		}
+		if del {
+			gBreaker.add(breakIdentities, 1)
+		} else if c.email == "" {
+			blanked = 1 + int(pAffected)
+		}
+		if del {
+			deleted++
+		} else {
+			if c.valid {
+				changes++
+			} else {
+				cleanups++
+			}
+		}
+		if c.mismatch {
+			mismatch++
+		}
+		if mtx != nil {
+			mtx.Unlock()
+		}
+		return
+	}
+	// rewriteIdentity - row by row fallback, used for batches with duplicate-key conflicts
+	rewriteIdentity := func(c identityChange) (blanked int, err error) {
+		var (
+			del                 bool
+			affected, pAffected int64
+		)
+		err = retryTX(
+			ctx,
+			"identity "+c.id,
+			func() (e error) {
+				del, affected, pAffected, e = rewriteIdentityEmail(ctx, db, c, !skipProfiles)
+				return
+			},
+		)
 		if err != nil {
+			fmt.Printf("error on #%d: (%s->%s,src=%s,email=%s->%s,name=%s,uname=%s), rolled back: %+v\n", c.i, c.id, c.uuid, c.source, c.currEmail, c.email, c.name, c.username, err)
+			if ctx.Err() != nil {
+				unprocessed("identity #%d %s (email '%s'->'%s'): rolled back", c.i, c.id, c.currEmail, c.email)
+			}
+			return
+		}
+		blanked = recordIdentity(c, del, affected, pAffected)
+		return
+	}
+	identitiesWriter := newBatchWriter(
+		batchSize,
+		func(batch []interface{}) (err error) {
+			cs := make([]identityChange, len(batch))
+			for i, c := range batch {
+				change, ok := c.(identityChange)
+				if !ok {
+					return fmt.Errorf("unexpected change type %T in batch of identities", c)
+				}
+				cs[i] = change
+			}
+			blanked := 0
+			profileConds, profileArgs := []string{}, []interface{}{}
+			for _, c := range cs {
+				if c.email == "" {
+					blanked++
+					profileConds = append(profileConds, "(uuid = ? and email = ?)")
+					profileArgs = append(profileArgs, c.uidentity, c.currEmail)
+				}
+			}
+			// profiles having the blanked identities' emails are blanked with them
+			if blanked > 0 && !skipProfiles {
+				var profiles int
+				profiles, err = countRows(ctx, readDB(db), "profiles", strings.Join(profileConds, " or "), profileArgs...)
+				if err != nil {
+					return
+				}
+				blanked += profiles
+			}
+			// the whole batch is refused when it would cross a threshold, otherwise its blanked emails are reserved
+			// and settled with the ones actually blanked once it is written
+			if gBreaker.isTripped() || !gBreaker.allow(breakBlanked, blanked) {
+				for _, c := range cs {
+					unprocessed("identity #%d %s (email '%s'->'%s'): circuit breaker tripped", c.i, c.id, c.currEmail, c.email)
+				}
+				err = fmt.Errorf("batch of %d identities not written: %w", len(cs), errTripped)
+				return
+			}
+			written := 0
+			defer func() {
+				gBreaker.settle(breakBlanked, blanked, written)
+			}()
+			var found map[string]int64
+			err = retryTX(
+				ctx,
+				fmt.Sprintf("batch of %d identities", len(cs)),
+				func() (e error) {
+					found, e = writeIdentityBatch(ctx, db, cs, !skipProfiles)
+					return
+				},
+			)
+			if isDuplicateKeyError(err) {
+				fmt.Printf("duplicate identity in batch of %d changes, rolled back, falling back to row by row processing\n", len(cs))
+				if mtx != nil {
+					mtx.Lock()
+				}
+				fallbacks++
+				if mtx != nil {
+					mtx.Unlock()
+				}
+				errs := []error{}
+				for _, c := range cs {
+					n, e := rewriteIdentity(c)
+					written += n
+					if e != nil {
+						errs = append(errs, e)
+					}
+				}
+				err = nil
+				nErrs := len(errs)
+				if nErrs > 0 {
+					err = fmt.Errorf("%d errors: %+v", nErrs, errs)
+				}
+				return
+			}
+			if err != nil {
+				fmt.Printf("error writing batch of %d identities, rolled back: %+v\n", len(cs), err)
+				if ctx.Err() != nil {
+					for _, c := range cs {
+						unprocessed("identity #%d %s (email '%s'->'%s'): rolled back", c.i, c.id, c.currEmail, c.email)
+					}
+				}
+				return
+			}
+			for _, c := range cs {
+				affected, pAffected := int64(0), int64(0)
+				res, ok := found[c.id]
+				if ok {
+					affected, pAffected = 1, res
+				}
+				written += recordIdentity(c, false, affected, pAffected)
+			}
+			return
+		},
+	)
+	processIdentity := func(ch chan error, i int, identity emailIdentity) (err error) {
+		defer func() {
+			if ch != nil {
+				ch <- err
+			}
+		}()
+		currEmail := identity.email
+		valid, email := isValidEmail(currEmail, validateDomain, guess)
+		if valid && email == currEmail {
+			return
+		}
+		if gDebug {
+			fmt.Printf("processing identity email #%d (valid: %v): '%s'->'%s'\n", i, valid, currEmail, email)
+		}
+		id := identity.id
+		source := identity.source
+		name := identity.name
+		username := identity.username
+		prevUUID, e := uuidAffs(source, currEmail, name, username)
+		if e != nil {
+			fmt.Printf("cannot calculate previous identity ID #%d, skipping: %+v\n", i, e)
+			quarantineIdentity(id, source, name, username, currEmail, email, e)
+			return
+		}
+		if gDebug && prevUUID != id {
+			fmt.Printf("notice: old identity ID calculation mismatch for (src=%s,email=%s->%s,name=%s,uname=%s)\n", source, currEmail, email, name, username)
+		}
+		uuid, e := uuidAffs(source, email, name, username)
+		if e != nil {
+			fmt.Printf("cannot calculate new identity ID #%d, skipping: %+v\n", i, e)
+			quarantineIdentity(id, source, name, username, currEmail, email, e)
+			return
+		}
+		err = identitiesWriter.add(
+			identityChange{
+				i:         i,
+				valid:     valid,
+				mismatch:  prevUUID != id,
+				id:        id,
+				uuid:      uuid,
+				uidentity: identity.uuid,
+				source:    source,
+				name:      name,
+				username:  username,
+				currEmail: currEmail,
+				email:     email,
+			},
+		)
+		return
+	}
+	if !skipIdentities && phase == "identities" {
+		pool := newWorkerPool(thrN)
+		i := 0
+		lastKey, where, args := startKey, scopeWhere, scopeArgs
+		if startKey != "" {
+			where, args = andWhere(where, "id > ?"), append(args, startKey)
+		}
+		n, e := scanPages(
+			ctx,
+			db,
+			"id, coalesce(uuid, ''), source, coalesce(name, ''), coalesce(username, ''), email",
+			"identities",
+			"id",
+			andWhere("email is not null and trim(email) != ''", where),
+			args,
+			func(rows *sql.Rows) (string, error) {
+				err := rows.Scan(&id, &uuid, &source, &name, &username, &email)
+				if err != nil {
+					return "", err
+				}
+				page = append(page, emailIdentity{id: id, uuid: uuid, source: source, name: name, username: username, email: email})
+				return id, nil
+			},
+			func() error {
+				gBreaker.scan(len(page), breakBlanked, breakIdentities)
+				for _, identity := range page {
+					if isStopping() {
+						unprocessed("identities (emails cleanup): rows with id >= '%s' with non-empty email", identity.id)
+						page = nil
+						return errStopped
+					}
+					identity, idx := identity, i
+					pool.run(
+						func(ch chan error) error {
+							return processIdentity(ch, idx, identity)
+						},
+					)
+					lastKey = identity.id
+					i++
+				}
+				page = nil
+				if cp.due() {
+					// all dispatched rows must be committed before their key is saved
+					pErrs := pool.wait()
+					ef := identitiesWriter.flush()
+					if ef != nil {
+						errs = append(errs, ef)
+					}
+					cp.save(lastKey, counters(), append(append([]error{}, errs...), pErrs...))
+				}
+				return nil
+			},
+		)
+		errs = append(errs, pool.wait()...)
+		ef := identitiesWriter.flush()
+		if ef != nil {
+			errs = append(errs, ef)
+		}
+		if e != nil {
+			err = e
 			return
 		}
-		if gDebug {
-			key := getKey(source, username, email)
-			_, dup := missingMap[key]
-			if dup {
-				fmt.Printf("missing names: non-unique key: %s\n", key)
-			}
-			missingMap[key] = struct{}{}
+		fmt.Printf("%d identities with non-empty email\n", n)
+		if isStopping() {
+			cp.save(lastKey, counters(), errs)
+		} else {
+			cp.next("profiles", counters(), errs)
 		}
-		// log.Println(id, uuid, source, name, username, email)
-		ids = append(ids, id)
-		uuids = append(uuids, uuid)
-		sources = append(sources, source)
-		names = append(names, name)
-		usernames = append(usernames, username)
-		emails = append(emails, email)
+		startKey = ""
 	}
-	err = rows.Err()
-	if err != nil {
-		return
+	if cleanups > 0 || changes > 0 || quarantined > 0 {
+		fmt.Printf("identities: cleanups:%d, changes:%d, deleted:%d, mismatch: %d, quarantined: %d, profiles: %d, batch fallbacks: %d\n", cleanups, changes, deleted, mismatch, quarantined, iprofiles, fallbacks)
 	}
-	err = rows.Close()
-	if err != nil {
-		return
+	e := writeQuarantine()
+	if e != nil {
+		errs = append(errs, e)
 	}
-	fmt.Printf("%d identities with missing name suffix and non-empty username or email\n", len(ids))
-	rows, err = query(
-		db,
-		nil,
-		"select id, uuid, source, username, email from identities where (name is null or trim(name) = '') "+
-			"and ((username is not null and trim(username) != '') or (email is not null and trim(email) != ''))",
+	// Profiles
+	var (
+		puuid  string
+		pemail string
+		ppage  []emailProfile
 	)
-	if err != nil {
-		return
-	}
-	emptyMap := map[string]struct{}{}
-	for rows.Next() {
-		err = rows.Scan(&id, &uuid, &source, &username, &email)
-		if err != nil {
+	profilesWriter := newBatchWriter(
+		batchSize,
+		func(batch []interface{}) (err error) {
+			cs := make([]profileChange, len(batch))
+			for i, c := range batch {
+				change, ok := c.(profileChange)
+				if !ok {
+					return fmt.Errorf("unexpected change type %T in batch of profiles", c)
+				}
+				cs[i] = change
+			}
+			blanked := 0
+			for _, c := range cs {
+				if c.email == "" {
+					blanked++
+				}
+			}
+			if gBreaker.isTripped() || !gBreaker.allow(breakBlanked, blanked) {
+				for _, c := range cs {
+					unprocessed("profile #%d %s (email '%s'->'%s'): circuit breaker tripped", c.i, c.uuid, c.currEmail, c.email)
+				}
+				err = fmt.Errorf("batch of %d profiles not written: %w", len(cs), errTripped)
+				return
+			}
+			written := 0
+			defer func() {
+				gBreaker.settle(breakBlanked, blanked, written)
+			}()
+			var found map[string]struct{}
+			err = retryTX(
+				ctx,
+				fmt.Sprintf("batch of %d profiles", len(cs)),
+				func() (e error) {
+					found, e = writeProfileBatch(ctx, db, cs)
+					return
+				},
+			)
+			if err != nil {
+				fmt.Printf("error writing batch of %d profiles, rolled back: %+v\n", len(cs), err)
+				if ctx.Err() != nil {
+					for _, c := range cs {
+						unprocessed("profile #%d %s (email '%s'->'%s'): rolled back", c.i, c.uuid, c.currEmail, c.email)
+					}
+				}
+				return
+			}
+			for _, c := range cs {
+				_, ok := found[c.uuid]
+				if !ok {
+					fmt.Printf("no rows affected for (uuid=%s,email=%s->%s)\n", c.uuid, c.currEmail, c.email)
+					continue
+				}
+				affected := int64(1)
+				// if gDebug {
+				fmt.Printf("processed #%d profile (valid=%v,%d,%s,%s->%s)\n", c.i, c.valid, affected, c.uuid, c.currEmail, c.email)
+				// }
+				if mtx != nil {
+					mtx.Lock()
+				}
+				if c.valid {
+					pchanges++
+				} else {
+					pcleanups++
+				}
+				if mtx != nil {
+					mtx.Unlock()
+				}
+				if c.email == "" {
+					written++
+				}
+			}
+			return
+		},
+	)
+	processProfile := func(ch chan error, i int, profile emailProfile) (err error) {
+		defer func() {
+			if ch != nil {
+				ch <- err
+			}
+		}()
+		currEmail := profile.email
+		valid, email := isValidEmail(currEmail, validateDomain, guess)
+		if valid && email == currEmail {
 			return
 		}
-		key := getKey(source, username, email)
-		_, dup := emptyMap[key]
-		if dup {
-			fmt.Printf("empty names: non-unique key: %s\n", key)
-			// We merge into first found, to skip such cases uncomment 'continue' line
-			// continue
-		}
-		emptyMap[key] = struct{}{}
-		idMap[key] = id
-		if uuid != nil {
-			uuidMap[key] = *uuid
+		if gDebug {
+			fmt.Printf("processing profile email #%d (valid %v): '%s'->'%s'\n", i, valid, currEmail, email)
 		}
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
+		err = profilesWriter.add(profileChange{i: i, valid: valid, uuid: profile.uuid, currEmail: currEmail, email: email})
 		return
 	}
-	fmt.Printf("%d identities with empty/null name and non-empty username or email\n", len(emptyMap))
-	errs := []error{}
-	if thrN > 0 {
-		mtx = &sync.Mutex{}
-		ch := make(chan error)
-		nThreads := 0
-		for i := range ids {
-			go func(ch chan error, i int) {
-				_ = processIdentity(ch, i)
-			}(ch, i)
-			nThreads++
-			if nThreads == thrN {
-				e := <-ch
-				nThreads--
-				if e != nil {
-					errs = append(errs, e)
-				}
-			}
-		}
-		for nThreads > 0 {
-			e := <-ch
-			nThreads--
-			if e != nil {
-				errs = append(errs, e)
-			}
+	if !skipProfiles && isStopping() {
+		unprocessed("profiles (emails cleanup): not started")
+	} else if !skipProfiles {
+		pool := newWorkerPool(thrN)
+		i, dryEmpty := 0, 0
+		lastKey, where, args := startKey, profilesWhere, profilesArgs
+		if startKey != "" {
+			where, args = andWhere(where, "uuid > ?"), append(args, startKey)
 		}
-	} else {
-		for i := range ids {
-			e := processIdentity(nil, i)
-			if e != nil {
-				errs = append(errs, e)
-			}
+		np, e := scanPages(
+			ctx,
+			db,
+			"uuid, email",
+			"profiles",
+			"uuid",
+			andWhere("email is not null and trim(email) != ''", where),
+			args,
+			func(rows *sql.Rows) (string, error) {
+				err := rows.Scan(&puuid, &pemail)
+				if err != nil {
+					return "", err
+				}
+				if gDry {
+					// profile email could be already changed together with its identity
+					simulated, ok := gDryState.simulatedProfileEmail(puuid)
+					if ok {
+						if strings.TrimSpace(simulated) == "" {
+							dryEmpty++
+							return puuid, nil
+						}
+						pemail = simulated
+					}
+				}
+				ppage = append(ppage, emailProfile{uuid: puuid, email: pemail})
+				return puuid, nil
+			},
+			func() error {
+				gBreaker.scan(len(ppage), breakBlanked)
+				for _, profile := range ppage {
+					if isStopping() {
+						unprocessed("profiles (emails cleanup): rows with uuid >= '%s' with non-empty email", profile.uuid)
+						ppage = nil
+						return errStopped
+					}
+					profile, idx := profile, i
+					pool.run(
+						func(ch chan error) error {
+							return processProfile(ch, idx, profile)
+						},
+					)
+					lastKey = profile.uuid
+					i++
+				}
+				ppage = nil
+				if cp.due() {
+					pErrs := pool.wait()
+					ef := profilesWriter.flush()
+					if ef != nil {
+						errs = append(errs, ef)
+					}
+					cp.save(lastKey, counters(), append(append([]error{}, errs...), pErrs...))
+				}
+				return nil
+			},
+		)
+		errs = append(errs, pool.wait()...)
+		ef := profilesWriter.flush()
+		if ef != nil {
+			errs = append(errs, ef)
 		}
-	}
-	if merges > 0 {
-		fmt.Printf("merged %d profiles\n", merges)
-	}
-	if os.Getenv("DELETE_ORPHANED") != "" {
-		res, e := exec(db, nil, "delete from uidentities where uuid not in (select uuid from identities)")
 		if e != nil {
-			errs = append(errs, e)
-		} else if !gDry {
-			affected, _ := res.RowsAffected()
-			if affected > 0 {
-				fmt.Printf("deleted %d orphaned profiles\n", affected)
-			}
+			err = e
+			return
 		}
+		fmt.Printf("%d profiles with non-empty email\n", np-dryEmpty)
+		if isStopping() {
+			cp.save(lastKey, counters(), errs)
+		}
+	}
+	if pcleanups > 0 || pchanges > 0 {
+		fmt.Printf("profiles: cleanups:%d, changes:%d\n", pcleanups, pchanges)
 	}
 	nErrs := len(errs)
 	if nErrs > 0 {
 		err = fmt.Errorf("%d errors: %+v", nErrs, errs)
+		return
+	}
+	err = inc.save(ctx, db)
+	if err != nil || isStopping() {
+		return
 	}
+	cp.next("done", counters(), nil)
 	return
 }
 
-func cleanupEmails(db *sqlx.DB) (err error) {
-	thrN := getThreadsNum()
-	fmt.Printf("Using %d threads\n", thrN)
+// schemaTable - columns, unique keys and foreign keys the cleanup depends on
+type schemaTable struct {
+	name    string
+	columns []string
+	uniques [][]string
+	fks     []schemaFK
+}
+
+// schemaFK - foreign key: column references refTable(refColumn)
+type schemaFK struct {
+	column    string
+	refTable  string
+	refColumn string
+}
+
+// requiredSchema - affiliation database schema parts used by this tool
+var requiredSchema = []schemaTable{
+	{
+		name:    "uidentities",
+		columns: []string{"uuid", "last_modified"},
+		uniques: [][]string{{"uuid"}},
+	},
+	{
+		name:    "identities",
+		columns: []string{"id", "uuid", "source", "name", "username", "email", "last_modified"},
+		uniques: [][]string{{"id"}},
+		fks:     []schemaFK{{column: "uuid", refTable: "uidentities", refColumn: "uuid"}},
+	},
+	{
+		name:    "profiles",
+		columns: []string{"uuid", "email"},
+		uniques: [][]string{{"uuid"}},
+		fks:     []schemaFK{{column: "uuid", refTable: "uidentities", refColumn: "uuid"}},
+	},
+	{
+		name:    "enrollments",
+		columns: []string{"id", "uuid"},
+		uniques: [][]string{{"id"}},
+		fks:     []schemaFK{{column: "uuid", refTable: "uidentities", refColumn: "uuid"}},
+	},
+}
+
+// checkSchema - verify that affiliation database has all required tables, columns, unique keys and foreign keys
+// returns error listing everything that is missing
+func checkSchema(ctx context.Context, db *sqlx.DB) (err error) {
+	tables := []interface{}{}
+	for _, table := range requiredSchema {
+		tables = append(tables, table.name)
+	}
+	in := "(?" + strings.Repeat(",?", len(tables)-1) + ")"
 	var (
-		id        string
-		source    string
-		name      string
-		username  string
-		email     string
-		ids       []string
-		sources   []string
-		names     []string
-		usernames []string
-		emails    []string
-		rows      *sql.Rows
-		mtx       *sync.Mutex
+		rows   *sql.Rows
+		table  string
+		column string
+		index  string
+		refTab string
+		refCol string
 	)
-	rows, err = query(db, nil, "select id, source, coalesce(name, ''), coalesce(username, ''), email from identities where email is not null and trim(email) != ''")
+	columns := make(map[string]struct{})
+	columnsQuery, uniquesQuery, fksQuery := gDialect.schemaQueries(in)
+	rows, err = query(ctx, db, nil, columnsQuery, tables...)
 	if err != nil {
 		return
 	}
 	for rows.Next() {
-		err = rows.Scan(&id, &source, &name, &username, &email)
+		err = rows.Scan(&table, &column)
 		if err != nil {
+			_ = rows.Close()
 			return
 		}
-		ids = append(ids, id)
-		sources = append(sources, source)
-		names = append(names, name)
-		usernames = append(usernames, username)
-		emails = append(emails, email)
+		columns[table+"."+column] = struct{}{}
 	}
 	err = rows.Err()
 	if err != nil {
+		_ = rows.Close()
 		return
 	}
 	err = rows.Close()
 	if err != nil {
 		return
 	}
-	n := len(ids)
-	fmt.Printf("%d identities with non-empty email\n", n)
-	validateDomain := os.Getenv("SKIP_VALIDATE_DOMAIN") == ""
-	guess := os.Getenv("SKIP_GUESS_EMAIL") == ""
-	skipIdentities := os.Getenv("SKIP_IDENTITIES") != ""
-	skipProfiles := os.Getenv("SKIP_PROFILES") != ""
-	cleanups, changes, deleted, mismatch := 0, 0, 0, 0
-	errs := []error{}
-	processIdentity := func(ch chan error, i int) (err error) {
-		defer func() {
-			if ch != nil {
-				ch <- err
-			}
-		}()
-		currEmail := emails[i]
-		valid, email := isValidEmail(currEmail, validateDomain, guess)
-		if valid && email == currEmail {
-			return
-		}
-		if gDebug {
-			fmt.Printf("processing identity email #%d (valid: %v): '%s'->'%s'\n", i, valid, currEmail, email)
-		}
-		id := ids[i]
-		source := sources[i]
-		name := names[i]
-		username := usernames[i]
-		prevUUID := uuidAffs(source, currEmail, name, username)
-		if gDebug && prevUUID != id {
-			fmt.Printf("notice: old identity ID calculation mismatch for (src=%s,email=%s->%s,name=%s,uname=%s)\n", source, currEmail, email, name, username)
-		}
-		uuid := uuidAffs(source, email, name, username)
-		if prevUUID == "" || uuid == "" {
-			fmt.Printf("prev uuid is empty or new uuid is empty: '%s', '%s', skipping\n", prevUUID, uuid)
-		}
-		var res sql.Result
-		res, err = execQuiet(db, nil, "update identities set email = ?, id = ? where id = ?", email, uuid, id)
-		del := false
+	uniques := make(map[string]struct{})
+	rows, err = query(ctx, db, nil, uniquesQuery, tables...)
+	if err != nil {
+		return
+	}
+	uniqueCols := make(map[string][]string)
+	for rows.Next() {
+		err = rows.Scan(&table, &index, &column)
 		if err != nil {
-			if strings.Contains(err.Error(), "Duplicate entry") {
-				fmt.Printf("correct identity already exists #%d (src=%s,name=%s,uname=%s,email=%s->%s), deleting current %s\n", i, source, name, username, currEmail, email, id)
-				res, err = exec(db, nil, "delete from identities where id = ?", id)
-				if err != nil {
-					return
-				}
-				del = true
-			} else {
-				fmt.Printf("error on #%d: update identities set email = '%s', id = '%s' where id = '%s'\n", i, email, uuid, id)
-				return
-			}
-		}
-		affected := int64(-1)
-		if !gDry {
-			affected, _ = res.RowsAffected()
-			if affected == 0 {
-				fmt.Printf("no rows affected for (%s->%s,src=%s,email=%s->%s,name=%s,uname=%s)\n", id, uuid, source, currEmail, email, name, username)
-				return
-			}
-		}
-		// if gDebug {
-		fmt.Printf("processed #%d identity (valid=%v,del=%v,%d,%s->%s,src=%s,email=%s->%s,name=%s,uname=%s)\n", i, valid, del, affected, id, uuid, source, currEmail, email, name, username)
-		// }
-		if mtx != nil {
-			mtx.Lock()
-		}
-		if del {
-			deleted++
-		} else {
-			if valid {
-				changes++
-			} else {
-				cleanups++
-			}
-		}
-		if prevUUID != id {
-			mismatch++
-		}
-		if mtx != nil {
-			mtx.Unlock()
+			_ = rows.Close()
+			return
 		}
+		uniqueCols[table+"."+index] = append(uniqueCols[table+"."+index], column)
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
 		return
 	}
-	if !skipIdentities {
-		if thrN > 0 {
-			mtx = &sync.Mutex{}
-			ch := make(chan error)
-			nThreads := 0
-			for i := range ids {
-				go func(ch chan error, i int) {
-					_ = processIdentity(ch, i)
-				}(ch, i)
-				nThreads++
-				if nThreads == thrN {
-					e := <-ch
-					nThreads--
-					if e != nil {
-						errs = append(errs, e)
-					}
-				}
-			}
-			for nThreads > 0 {
-				e := <-ch
-				nThreads--
-				if e != nil {
-					errs = append(errs, e)
-				}
-			}
-		} else {
-			for i := range ids {
-				e := processIdentity(nil, i)
-				if e != nil {
-					errs = append(errs, e)
-				}
-			}
-		}
+	err = rows.Close()
+	if err != nil {
+		return
 	}
-	if cleanups > 0 || changes > 0 {
-		fmt.Printf("identities: cleanups:%d, changes:%d, deleted:%d, mismatch: %d\n", cleanups, changes, deleted, mismatch)
+	for key, cols := range uniqueCols {
+		uniques[strings.Split(key, ".")[0]+"("+strings.Join(cols, ",")+")"] = struct{}{}
 	}
-	// Profiles
-	rows, err = query(db, nil, "select uuid, email from profiles where email is not null and trim(email) != ''")
+	fks := make(map[string]struct{})
+	rows, err = query(ctx, db, nil, fksQuery, tables...)
 	if err != nil {
 		return
 	}
-	var (
-		puuid   string
-		pemail  string
-		puuids  []string
-		pemails []string
-	)
 	for rows.Next() {
-		err = rows.Scan(&puuid, &pemail)
+		err = rows.Scan(&table, &column, &refTab, &refCol)
 		if err != nil {
+			_ = rows.Close()
 			return
 		}
-		puuids = append(puuids, puuid)
-		pemails = append(pemails, pemail)
+		fks[table+"("+column+") -> "+refTab+"("+refCol+")"] = struct{}{}
 	}
 	err = rows.Err()
 	if err != nil {
+		_ = rows.Close()
 		return
 	}
 	err = rows.Close()
 	if err != nil {
 		return
 	}
-	np := len(puuids)
-	fmt.Printf("%d profiles with non-empty email\n", np)
-	pcleanups, pchanges := 0, 0
-	processProfile := func(ch chan error, i int) (err error) {
-		defer func() {
-			if ch != nil {
-				ch <- err
+	diff := []string{}
+	for _, table := range requiredSchema {
+		for _, column := range table.columns {
+			_, ok := columns[table.name+"."+column]
+			if !ok {
+				diff = append(diff, "- column "+table.name+"."+column)
 			}
-		}()
-		currEmail := pemails[i]
-		valid, email := isValidEmail(currEmail, validateDomain, guess)
-		if valid && email == currEmail {
-			return
-		}
-		if gDebug {
-			fmt.Printf("processing profile email #%d (valid %v): '%s'->'%s'\n", i, valid, currEmail, email)
-		}
-		uuid := puuids[i]
-		var res sql.Result
-		res, err = exec(db, nil, "update profiles set email = ? where uuid = ?", email, uuid)
-		if err != nil {
-			return
 		}
-		affected := int64(-1)
-		if !gDry {
-			affected, _ := res.RowsAffected()
-			if affected == 0 {
-				fmt.Printf("no rows affected for (uuid=%s,email=%s->%s)\n", uuid, currEmail, email)
-				return
+		for _, unique := range table.uniques {
+			key := table.name + "(" + strings.Join(unique, ",") + ")"
+			_, ok := uniques[key]
+			if !ok {
+				diff = append(diff, "- unique key "+key)
 			}
 		}
-		// if gDebug {
-		fmt.Printf("processed #%d profile (valid=%v,%d,%s,%s->%s)\n", i, valid, affected, uuid, currEmail, email)
-		// }
-		if mtx != nil {
-			mtx.Lock()
-		}
-		if valid {
-			pchanges++
-		} else {
-			pcleanups++
-		}
-		if mtx != nil {
-			mtx.Unlock()
-		}
-		return
-	}
-	if !skipProfiles {
-		if thrN > 0 {
-			mtx = &sync.Mutex{}
-			ch := make(chan error)
-			nThreads := 0
-			for i := range puuids {
-				go func(ch chan error, i int) {
-					_ = processProfile(ch, i)
-				}(ch, i)
-				nThreads++
-				if nThreads == thrN {
-					e := <-ch
-					nThreads--
-					if e != nil {
-						errs = append(errs, e)
-					}
-				}
-			}
-			for nThreads > 0 {
-				e := <-ch
-				nThreads--
-				if e != nil {
-					errs = append(errs, e)
-				}
-			}
-		} else {
-			for i := range puuids {
-				e := processProfile(nil, i)
-				if e != nil {
-					errs = append(errs, e)
-				}
+		for _, fk := range table.fks {
+			key := table.name + "(" + fk.column + ") -> " + fk.refTable + "(" + fk.refColumn + ")"
+			_, ok := fks[key]
+			if !ok {
+				diff = append(diff, "- foreign key "+key)
 			}
 		}
 	}
-	if pcleanups > 0 || pchanges > 0 {
-		fmt.Printf("profiles: cleanups:%d, changes:%d\n", pcleanups, pchanges)
+	if len(diff) > 0 {
+		err = fmt.Errorf("affiliation database schema differs from the expected one, missing:\n%s", strings.Join(diff, "\n"))
 	}
 	return
 }
@@ -988,17 +5556,121 @@ func checkEmails() {
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run - run operations requested by environment, returns process exit code
+// deferred reporting and cleanup must be done before the process exits, so it is not done in main
+func run() (code int) {
+	defer func() { code = exitCode() }()
+	rand.Seed(time.Now().UnixNano())
 	db := initAffsDB()
-	op := os.Getenv("CLEANUP_PROFILES") != ""
+	gRunID = getRunID()
+	fmt.Printf("run ID: %s\n", gRunID)
+	gOperator = getOperator()
+	gScope = getScope()
+	fmt.Printf("scope: %s\n", gScope)
+	gBreaker = getBreaker()
+	fmt.Printf("circuit breaker: %s\n", gBreaker)
+	api := newAffsClient(os.Getenv("API_URL"), newJWTTokenManager(), getThreadsNum())
+	defer api.printStats()
+	if os.Getenv("RESUME") != "" {
+		err := loadCheckpoint(os.Getenv("RESUME"))
+		if err != nil {
+			fmt.Printf("cannot resume run %s: %+v\n", os.Getenv("RESUME"), err)
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+	defer gBreaker.report()
+	defer printUnprocessed()
+	defer printRetries()
+	defer closeBackup()
+	if os.Getenv("PLAN") != "" {
+		var err error
+		gPlan, err = newPlanWriter(os.Getenv("PLAN"))
+		if err != nil {
+			fmt.Printf("cannot create plan: %+v\n", err)
+			return
+		}
+		defer closePlan()
+	}
+	var schemaErr error
+	op := os.Getenv("CHECK_SCHEMA") != ""
 	if op {
-		err := cleanupProfiles(db)
+		schemaErr = checkSchema(ctx, db)
+		if schemaErr != nil {
+			fmt.Printf("schema check error: %+v\n", schemaErr)
+		} else {
+			fmt.Printf("schema check passed\n")
+		}
+	}
+	modify := os.Getenv("RESTORE") != "" || os.Getenv("APPLY") != "" || os.Getenv("CLEANUP_PROFILES") != "" || os.Getenv("CLEANUP_EMAILS") != "" ||
+		os.Getenv("CLEANUP_ORPHANS") != ""
+	if modify && os.Getenv("SKIP_SCHEMA_CHECK") == "" {
+		if !op {
+			schemaErr = checkSchema(ctx, db)
+		}
+		if schemaErr != nil {
+			fmt.Printf("schema check error, aborting: %+v\n", schemaErr)
+			return
+		}
+	}
+	if modify && !gDry {
+		lock, err := acquireRunLock(ctx, db)
+		if err != nil {
+			fmt.Printf("cannot acquire run lock, aborting: %+v\n", err)
+			if errors.Is(err, errRunLocked) {
+				abortRun(err)
+			}
+			return
+		}
+		defer lock.release()
+		err = initAudit(ctx, db)
+		if err != nil {
+			fmt.Printf("cannot create audit table, aborting: %+v\n", err)
+			return
+		}
+		err = initState(ctx, db)
+		if err != nil {
+			fmt.Printf("cannot create state table, aborting: %+v\n", err)
+			return
+		}
+	}
+	op = os.Getenv("RESTORE") != ""
+	if op && isStopping() {
+		unprocessed("restore: not started")
+	} else if op {
+		err := restoreBackup(ctx, db)
+		if err != nil {
+			fmt.Printf("restore error: %+v\n", err)
+		}
+	}
+	op = os.Getenv("APPLY") != ""
+	if op && isStopping() {
+		unprocessed("apply plan: not started")
+	} else if op {
+		err := applyPlan(ctx, db, api)
+		if err != nil {
+			fmt.Printf("apply plan error: %+v\n", err)
+		}
+	}
+	op = os.Getenv("CLEANUP_PROFILES") != ""
+	if op && isStopping() {
+		unprocessed("cleanup profiles: not started")
+	} else if op {
+		err := cleanupProfiles(ctx, db, api)
 		if err != nil {
 			fmt.Printf("cleanup profiles error: %+v\n", err)
 		}
 	}
 	op = os.Getenv("CLEANUP_EMAILS") != ""
-	if op {
-		err := cleanupEmails(db)
+	if op && isStopping() {
+		unprocessed("cleanup emails: not started")
+	} else if op {
+		err := cleanupEmails(ctx, db)
 		if err != nil {
 			fmt.Printf("cleanup emails error: %+v\n", err)
 		}
@@ -1006,8 +5678,18 @@ func main() {
 			fmt.Printf("email cache:\n%+v\n", emailsCache)
 		}
 	}
+	op = os.Getenv("CLEANUP_ORPHANS") != ""
+	if op && isStopping() {
+		unprocessed("cleanup orphans: not started")
+	} else if op {
+		err := cleanupOrphans(ctx, db, orphanKinds)
+		if err != nil {
+			fmt.Printf("cleanup orphans error: %+v\n", err)
+		}
+	}
 	op = os.Getenv("CHECK_EMAILS") != ""
 	if op {
 		checkEmails()
 	}
+	return
 }
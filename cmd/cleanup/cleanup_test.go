@@ -0,0 +1,688 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestSQLiteDSN(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint string
+		want     string
+	}{
+		{"t.db", "t.db?_foreign_keys=1&_busy_timeout=60000"},
+		{"sqlite://t.db", "t.db?_foreign_keys=1&_busy_timeout=60000"},
+		{"t.db?mode=ro", "t.db?mode=ro&_foreign_keys=1&_busy_timeout=60000"},
+		{"file:t.db?_foreign_keys=0", "file:t.db?_foreign_keys=0&_busy_timeout=60000"},
+		{"t.db?_fk=1", "t.db?_fk=1&_busy_timeout=60000"},
+		{"t.db?_busy_timeout=5", "t.db?_busy_timeout=5&_foreign_keys=1"},
+		{"t.db?_fk=0&_timeout=5", "t.db?_fk=0&_timeout=5"},
+	} {
+		got := sqliteDialect{}.dsn(tc.endpoint)
+		if got != tc.want {
+			t.Errorf("dsn(%q) = %q, want %q", tc.endpoint, got, tc.want)
+		}
+	}
+}
+
+// testSchema - affiliation tables used by the cleanups, with the same keys as in MySQL
+var testSchema = []string{
+	"create table uidentities(uuid varchar(128) primary key, last_modified datetime default current_timestamp)",
+	"create table identities(id varchar(128) primary key, name varchar(128), email varchar(128), username varchar(128), source varchar(32) not null, " +
+		"uuid varchar(128) references uidentities(uuid) on delete cascade, last_modified datetime default current_timestamp, unique(name, email, username, source))",
+	"create table profiles(uuid varchar(128) primary key references uidentities(uuid) on delete cascade, name varchar(128), email varchar(128))",
+	"create table enrollments(id integer primary key, uuid varchar(128) references uidentities(uuid) on delete cascade, organization_id int)",
+}
+
+// testDB - SQLite affiliation database in a temporary directory (also the working directory for backups, checkpoints
+// and plans) with testSchema and rows inserted by stmts, run globals are initialized like in run
+func testDB(t *testing.T, stmts ...string) (context.Context, *sqlx.DB) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DB_DIALECT", "sqlite")
+	t.Setenv("DB_ENDPOINT", filepath.Join(dir, "test.db"))
+	t.Setenv("SKIP_VALIDATE_DOMAIN", "1")
+	t.Setenv("RUN_ID", "test-run")
+	db := initAffsDB()
+	reset := func() {
+		gStop = make(chan struct{})
+		gStopOnce = &sync.Once{}
+		gAbortErr = nil
+		gPlan = nil
+		gCheckpoint = nil
+		gResumed = false
+		gDryState = &dryRunState{mtx: &sync.Mutex{}, identities: map[string]bool{}, profiles: map[string]string{}}
+	}
+	reset()
+	t.Cleanup(
+		func() {
+			closeBackup()
+			_ = db.Close()
+			gDialect = mysqlDialect{}
+			gDry = false
+			reset()
+			_ = os.Chdir(wd)
+		},
+	)
+	ctx := context.Background()
+	for _, stmt := range append(append([]string{}, testSchema...), stmts...) {
+		_, err = db.ExecContext(ctx, stmt)
+		if err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	gRunID = getRunID()
+	gScope = getScope()
+	gBreaker = getBreaker()
+	err = initAudit(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = initState(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx, db
+}
+
+// testRows - query result rows as space separated values, sorted
+func testRows(t *testing.T, db *sqlx.DB, query string, args ...interface{}) []string {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rows.Close() }()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := []string{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items := []string{}
+		for _, value := range values {
+			items = append(items, value.String)
+		}
+		result = append(result, strings.Join(items, " "))
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+	sort.Strings(result)
+	return result
+}
+
+// testDirtyEmails - identities and profiles with emails to clean up, i1 collides with an existing identity after cleanup
+var testDirtyEmails = []string{
+	"insert into uidentities(uuid) values('u1'), ('u2')",
+	"insert into identities(id, name, email, username, source, uuid) values" +
+		"('i1', 'John', 'john at example.com', 'j', 'git', 'u1'), " +
+		"('0c549783cf6f6bf7526420bd094b5613f77a32b9', 'John', 'john@example.com', 'j', 'git', 'u1'), " +
+		"('i2', 'Zed', '<zed@example.com>', 'z', 'github', 'u2')",
+	"insert into profiles(uuid, name, email) values('u1', 'John', 'john at example.com'), ('u2', 'Zed', '<zed@example.com>')",
+}
+
+// TestCleanupEmailsDuplicateKey - a batch whose rewrite collides with an existing identity is rolled back
+// and processed row by row: the colliding identity is deleted, the other ones are rewritten
+func TestCleanupEmailsDuplicateKey(t *testing.T) {
+	ctx, db := testDB(t, testDirtyEmails...)
+	err := cleanupEmails(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := testRows(t, db, "select id, email from identities")
+	want := []string{
+		"0c549783cf6f6bf7526420bd094b5613f77a32b9 john@example.com",
+		"6083c62cc7fed58f237357e260bf0f3a74e69e8d zed@example.com",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("identities = %v, want %v", got, want)
+	}
+	got = testRows(t, db, "select operation from cleanup_audit where table_name = 'identities' and row_key = 'i1'")
+	if strings.Join(got, ",") != "delete" {
+		t.Errorf("audit records of identity i1 = %v, want [delete]", got)
+	}
+	got = testRows(t, db, "select email from profiles where uuid = 'u1'")
+	if strings.Join(got, ",") != "john@example.com" {
+		t.Errorf("profile u1 email = %v, want [john@example.com]", got)
+	}
+}
+
+// TestRestoreBackup - restoring a run's backup brings back rewritten identities under their old keys
+// (rows inserted under new keys are deleted), deleted identities and rewritten profiles
+func TestRestoreBackup(t *testing.T) {
+	ctx, db := testDB(t, testDirtyEmails...)
+	identities := "select id, email, uuid from identities"
+	profiles := "select uuid, email from profiles"
+	wantIdentities, wantProfiles := testRows(t, db, identities), testRows(t, db, profiles)
+	err := cleanupEmails(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeBackup()
+	if strings.Join(testRows(t, db, identities), ",") == strings.Join(wantIdentities, ",") {
+		t.Fatalf("identities not changed by cleanup: %v", wantIdentities)
+	}
+	t.Setenv("RESTORE", gRunID)
+	err = restoreBackup(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := testRows(t, db, identities)
+	if strings.Join(got, ",") != strings.Join(wantIdentities, ",") {
+		t.Errorf("restored identities = %v, want %v", got, wantIdentities)
+	}
+	got = testRows(t, db, profiles)
+	if strings.Join(got, ",") != strings.Join(wantProfiles, ",") {
+		t.Errorf("restored profiles = %v, want %v", got, wantProfiles)
+	}
+}
+
+// TestBackupRollback - before-images saved in a transaction are written only when it commits
+func TestBackupRollback(t *testing.T) {
+	ctx, db := testDB(t, testDirtyEmails...)
+	rows := []map[string]interface{}{{"id": "i1", "email": "john at example.com"}}
+	tx, err := beginTX(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backup(tx, "update", "identities", "id", "new-i1", rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollbackTX(tx)
+	_, err = os.Stat(backupFileName(gRunID))
+	if !os.IsNotExist(err) {
+		t.Fatalf("backup file written by rolled back transaction: %v", err)
+	}
+	tx, err = beginTX(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backup(tx, "update", "identities", "id", "new-i1", rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = commitTX(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeBackup()
+	data, err := os.ReadFile(backupFileName(gRunID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Errorf("backup records after commit = %d, want 1", n)
+	}
+}
+
+func TestGetBreakerLimit(t *testing.T) {
+	for _, tc := range []struct {
+		value  string
+		want   breakerLimit
+		panics bool
+	}{
+		{value: "", want: breakerLimit{}},
+		{value: "1000", want: breakerLimit{abs: 1000}},
+		{value: "5%", want: breakerLimit{pct: 5}},
+		{value: "1000,5%", want: breakerLimit{abs: 1000, pct: 5}},
+		{value: " 2.5% , 10 ", want: breakerLimit{abs: 10, pct: 2.5}},
+		{value: "100%", want: breakerLimit{pct: 100}},
+		{value: "abc", panics: true},
+		{value: "0", panics: true},
+		{value: "-1", panics: true},
+		{value: "0%", panics: true},
+		{value: "150%", panics: true},
+		{value: "1000,", panics: true},
+	} {
+		t.Setenv("BREAKER_TEST", tc.value)
+		var (
+			got      breakerLimit
+			panicked bool
+		)
+		func() {
+			defer func() { panicked = recover() != nil }()
+			got = getBreakerLimit("BREAKER_TEST")
+		}()
+		if panicked != tc.panics {
+			t.Errorf("getBreakerLimit(%q) panicked: %v, want %v", tc.value, panicked, tc.panics)
+			continue
+		}
+		if !tc.panics && got != tc.want {
+			t.Errorf("getBreakerLimit(%q) = %+v, want %+v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestBreakerReserve(t *testing.T) {
+	t.Setenv("BREAKER_BLANKED_EMAILS", "10")
+	// the breaker trips and stops the run, the stop is reset by the test DB cleanup
+	testDB(t)
+	b := gBreaker
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		allowed int
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.allow(breakBlanked, 3) {
+				mtx.Lock()
+				allowed++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 || b.counts[breakBlanked] != 9 {
+		t.Fatalf("concurrent batches of 3 allowed: %d (count %d), want 3 (count 9)", allowed, b.counts[breakBlanked])
+	}
+	// a rolled back batch releases its reservation, a partially written one keeps what it wrote
+	b.settle(breakBlanked, 3, 0)
+	b.settle(breakBlanked, 3, 1)
+	if b.counts[breakBlanked] != 4 {
+		t.Errorf("count after settling = %d, want 4", b.counts[breakBlanked])
+	}
+}
+
+// testInvalidEmails - identities whose emails are blanked, with BREAKER_BLANKED_EMAILS=2 the run is stopped before i3
+var testInvalidEmails = []string{
+	"insert into uidentities(uuid) values('u1')",
+	"insert into identities(id, name, email, username, source, uuid) values" +
+		"('i1', 'A', 'invalid1', 'a', 'git', 'u1'), ('i2', 'B', 'invalid2', 'b', 'git', 'u1'), ('i3', 'C', 'invalid3', 'c', 'git', 'u1')",
+}
+
+// TestCheckpointBreaker - batches refused by the tripped circuit breaker are not skipped by the checkpoint
+func TestCheckpointBreaker(t *testing.T) {
+	t.Setenv("BREAKER_BLANKED_EMAILS", "2")
+	t.Setenv("PAGE_SIZE", "1")
+	t.Setenv("BATCH_SIZE", "1")
+	t.Setenv("CHECKPOINT_INTERVAL", "1ns")
+	ctx, db := testDB(t, testInvalidEmails...)
+	err := cleanupEmails(ctx, db)
+	if err == nil || !strings.Contains(err.Error(), errTripped.Error()) {
+		t.Fatalf("cleanupEmails error = %v, want circuit breaker tripped", err)
+	}
+	got := testRows(t, db, "select name, coalesce(email, '') from identities")
+	want := []string{"A ", "B ", "C invalid3"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("identities = %q, want %q", got, want)
+	}
+	cp := gCheckpoint.Ops["cleanup_emails"]
+	if cp == nil || cp.Phase != "identities" || cp.Key != "i2" {
+		t.Errorf("checkpoint = %+v, want identities after i2", cp)
+	}
+}
+
+// TestCheckpointResume - a stopped run resumed from its checkpoint continues after the last committed key
+// with the counters of the stopped run
+func TestCheckpointResume(t *testing.T) {
+	t.Setenv("BREAKER_BLANKED_EMAILS", "2")
+	t.Setenv("PAGE_SIZE", "1")
+	t.Setenv("BATCH_SIZE", "1")
+	t.Setenv("CHECKPOINT_INTERVAL", "1ns")
+	ctx, db := testDB(t, testInvalidEmails...)
+	err := cleanupEmails(ctx, db)
+	if err == nil {
+		t.Fatal("cleanupEmails not stopped by circuit breaker")
+	}
+	// rows up to the checkpoint key are not read again
+	_, err = db.ExecContext(ctx, "insert into identities(id, name, email, username, source, uuid) values('i0', 'Z', 'invalid0', 'z', 'git', 'u1')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BREAKER_BLANKED_EMAILS", "")
+	gBreaker = getBreaker()
+	gStop, gStopOnce = make(chan struct{}), &sync.Once{}
+	gCheckpoint = nil
+	err = loadCheckpoint(gRunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cleanupEmails(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := testRows(t, db, "select name, coalesce(email, '') from identities")
+	want := []string{"A ", "B ", "C ", "Z invalid0"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("identities = %q, want %q", got, want)
+	}
+	cp := gCheckpoint.Ops["cleanup_emails"]
+	if cp == nil || cp.Phase != "done" || cp.Counters["cleanups"] != 3 {
+		t.Errorf("checkpoint = %+v, want done with 3 cleanups", cp)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		header   string
+		min, max time.Duration
+	}{
+		{"none", "", 0, 0},
+		{"seconds", "2", 2 * time.Second, 2 * time.Second},
+		{"padded seconds", " 30 ", 30 * time.Second, 30 * time.Second},
+		{"negative seconds", "-5", 0, 0},
+		{"invalid", "soon", 0, 0},
+		{"future date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{"past date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.header != "" {
+			resp.Header.Set("Retry-After", tc.header)
+		}
+		got := retryAfter(resp)
+		if got < tc.min || got > tc.max {
+			t.Errorf("%s: retryAfter(%q) = %v, want between %v and %v", tc.name, tc.header, got, tc.min, tc.max)
+		}
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	claims := func(payload string) string {
+		return "header." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".signature"
+	}
+	exp := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  time.Time
+	}{
+		{"exp claim", claims(`{"exp":1700000000}`), exp},
+		{"bearer prefix", "Bearer " + claims(`{"exp":1700000000,"sub":"x"}`), exp},
+		{"padded payload", "header." + base64.URLEncoding.EncodeToString([]byte(`{"exp":1700000000}`)) + ".signature", exp},
+		{"fractional exp", claims(`{"exp":1700000000.5}`), exp},
+		{"no exp claim", claims(`{"sub":"x"}`), time.Time{}},
+		{"zero exp", claims(`{"exp":0}`), time.Time{}},
+		{"not a JWT", "opaque-token", time.Time{}},
+		{"bad base64", "header.!!!.signature", time.Time{}},
+		{"bad JSON", claims(`{"exp":`), time.Time{}},
+		{"empty", "", time.Time{}},
+	} {
+		got := jwtExpiry(tc.token)
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: jwtExpiry(%q) = %v, want %v", tc.name, tc.token, got, tc.want)
+		}
+	}
+}
+
+// testTokens - token source failing with err once ctx is done, or right away when it is not cancellable
+type testTokens struct {
+	err error
+}
+
+func (s testTokens) token(ctx context.Context) (string, error) {
+	if ctx.Done() != nil {
+		<-ctx.Done()
+	}
+	return "", s.err
+}
+
+func (s testTokens) refresh(ctx context.Context, rejected string) (string, error) {
+	return s.token(ctx)
+}
+
+// TestTokenCancelled - a run cancelled while waiting for the API token is not aborted as a token failure
+func TestTokenCancelled(t *testing.T) {
+	t.Cleanup(
+		func() {
+			gStop, gStopOnce, gAbortErr = make(chan struct{}), &sync.Once{}, nil
+		},
+	)
+	api := newAffsClient("http://localhost", testTokens{err: errors.New("token refresh cancelled")}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := api.do(ctx, http.MethodGet, "/", true, nil, nil)
+	if !errors.Is(err, context.Canceled) || gAbortErr != nil {
+		t.Fatalf("cancelled do error = %v, abort error = %v, want context canceled without abort", err, gAbortErr)
+	}
+	err = api.do(context.Background(), http.MethodGet, "/", true, nil, nil)
+	if !errors.Is(err, errAPIToken) || !errors.Is(gAbortErr, errAPIToken) || exitCode() != exitAPIToken {
+		t.Errorf("do error = %v, abort error = %v, want token failure aborting the run", err, gAbortErr)
+	}
+}
+
+// TestPlanApply - a plan made by a dry run is applied, entries whose preconditions changed are refused
+func TestPlanApply(t *testing.T) {
+	ctx, db := testDB(t, testDirtyEmails...)
+	identities := "select id, name, email from identities"
+	before := testRows(t, db, identities)
+	var err error
+	gDry = true
+	gPlan, err = newPlanWriter("plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cleanupEmails(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closePlan()
+	gPlan, gDry = nil, false
+	if strings.Join(testRows(t, db, identities), ",") != strings.Join(before, ",") {
+		t.Fatalf("identities changed by dry run")
+	}
+	// new ID of identity i2 is computed from its name, so its rewrite must be refused
+	_, err = db.Exec("update identities set name = 'Zoe' where id = 'i2'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("APPLY", "plan.json")
+	err = applyPlan(ctx, db, newAffsClient("", newJWTTokenManager(), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := testRows(t, db, identities)
+	want := []string{
+		"0c549783cf6f6bf7526420bd094b5613f77a32b9 John john@example.com",
+		"i2 Zoe <zed@example.com>",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("identities after apply = %v, want %v", got, want)
+	}
+	got = testRows(t, db, "select uuid, email from profiles")
+	want = []string{"u1 john@example.com", "u2 zed@example.com"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("profiles after apply = %v, want %v", got, want)
+	}
+}
+
+// TestPlanWriteError - failure to write a plan entry aborts the run with its exit code instead of crashing
+func TestPlanWriteError(t *testing.T) {
+	testDB(t)
+	var err error
+	gPlan, err = newPlanWriter("plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = gPlan.file.Close()
+	err = planAdd(planEntry{Op: "update_identity", Table: "identities", Key: "i1"})
+	if !errors.Is(err, errPlanWrite) {
+		t.Fatalf("planAdd error = %v, want %v", err, errPlanWrite)
+	}
+	if !isStopping() {
+		t.Errorf("run not stopped after plan write error")
+	}
+	code := exitCode()
+	if code != exitPlanWrite {
+		t.Errorf("exit code = %d, want %d", code, exitPlanWrite)
+	}
+}
+
+// TestRunLock - a second run refuses to start (and exits with its exit code) while the lock is held,
+// the lock can be taken again after release and a stale lock left by a crashed run is taken over
+func TestRunLock(t *testing.T) {
+	ctx, db := testDB(t)
+	t.Setenv("RUN_LOCK_WAIT", "0")
+	t.Setenv("RUN_LOCK_STALE", "10m")
+	lock, err := acquireRunLock(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acquireRunLock(ctx, db)
+	if !errors.Is(err, errRunLocked) {
+		t.Fatalf("second acquire error = %v, want %v", err, errRunLocked)
+	}
+	abortRun(err)
+	code := exitCode()
+	if code != exitRunLocked {
+		t.Errorf("exit code = %d, want %d", code, exitRunLocked)
+	}
+	lock.release()
+	lock, err = acquireRunLock(ctx, db)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	lock.release()
+	heartbeat := time.Now().UTC().Add(-time.Hour)
+	_, err = db.Exec(
+		"insert into cleanup_run_lock(name, run_id, host, user_name, started_at, heartbeat) values(?, 'crashed-run', 'host', 'user', ?, ?)",
+		runLockName,
+		heartbeat,
+		heartbeat,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err = acquireRunLock(ctx, db)
+	if err != nil {
+		t.Fatalf("acquire of stale lock: %v", err)
+	}
+	got := testRows(t, db, "select run_id from cleanup_run_lock")
+	if strings.Join(got, ",") != gRunID {
+		t.Errorf("lock holders = %v, want [%s]", got, gRunID)
+	}
+	lock.release()
+}
+
+// TestScopeDomains - SCOPE_DOMAINS match emails at the domain, also malformed ones, and nothing else
+func TestScopeDomains(t *testing.T) {
+	_, db := testDB(
+		t,
+		"insert into uidentities(uuid) values('u1')",
+		"insert into identities(id, name, email, username, source, uuid) values"+
+			"('i1', 'a', 'a@my_site.com', 'a', 'git', 'u1'), "+
+			"('i2', 'b', 'b at my_site.com', 'b', 'git', 'u1'), "+
+			"('i3', 'c', '<c@MY_SITE.com> ', 'c', 'git', 'u1'), "+
+			"('i4', 'd', 'd@myxsite.com', 'd', 'git', 'u1'), "+
+			"('i5', 'e', 'e@my_site.com.evil', 'e', 'git', 'u1'), "+
+			"('i6', 'f', 'f@sub.my_site.com', 'f', 'git', 'u1'), "+
+			"('i7', 'g', 'g@100%.org', 'g', 'git', 'u1'), "+
+			"('i8', 'h', 'h@1000.org', 'h', 'git', 'u1')",
+	)
+	for _, tc := range []struct {
+		domains string
+		want    string
+	}{
+		{"my_site.com", "i1,i2,i3"},
+		{"@MY_SITE.COM", "i1,i2,i3"},
+		{"100%.org", "i7"},
+		{"site.com", ""},
+		{"my_site.com,1000.org", "i1,i2,i3,i8"},
+	} {
+		t.Setenv("SCOPE_DOMAINS", tc.domains)
+		where, args := getScope().domainsWhere("email")
+		got := testRows(t, db, "select id from identities where "+where, args...)
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("SCOPE_DOMAINS=%s matches %v, want [%s]", tc.domains, got, tc.want)
+		}
+	}
+}
+
+// testOrphans - unique identities o1-o3 without identities (with profiles and enrollments), an enrollment
+// and an identity without unique identity, u1 is in use
+var testOrphans = []string{
+	"insert into uidentities(uuid) values('u1'), ('o1'), ('o2'), ('o3')",
+	"insert into identities(id, name, email, username, source, uuid) values('i1', 'a', 'a@example.com', 'a', 'git', 'u1'), ('i2', 'b', '', 'b', 'git', null)",
+	"insert into profiles(uuid, name, email) values('u1', 'a', 'a@example.com'), ('o1', 'x', ''), ('o2', 'y', '')",
+	"insert into enrollments(id, uuid, organization_id) values(1, 'o1', 1), (2, 'o1', 2), (3, 'o2', 3), (4, 'o3', 4), (5, 'u1', 5), (6, null, 6)",
+}
+
+// TestCleanupOrphans - orphans are listed and deleted page by page (pages smaller than the number of orphans),
+// dry run only lists them, unique identities without identities are deleted with their dependents only
+func TestCleanupOrphans(t *testing.T) {
+	ctx, db := testDB(t, testOrphans...)
+	t.Setenv("BATCH_SIZE", "2")
+	tables := "select 'uidentities', uuid from uidentities union all select 'identities', id from identities " +
+		"union all select 'profiles', uuid from profiles union all select 'enrollments', id from enrollments"
+	before := testRows(t, db, tables)
+	listed := func() int {
+		data, err := os.ReadFile("orphans.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "\n")
+	}
+	gDry = true
+	err := cleanupOrphans(ctx, db, orphanKinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gDry = false
+	if strings.Join(testRows(t, db, tables), ",") != strings.Join(before, ",") {
+		t.Fatalf("rows deleted by dry run")
+	}
+	if n := listed(); n != 11 {
+		t.Errorf("dry run listed %d orphans, want 11", n)
+	}
+	kinds := orphanKindsOf(reasonOrphaned)
+	if len(kinds) != 3 || kinds[len(kinds)-1].table != "uidentities" {
+		t.Fatalf("kinds of orphaned unique identities = %+v, want enrollments, profiles, uidentities", kinds)
+	}
+	err = cleanupOrphans(ctx, db, kinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := listed(); n != 9 {
+		t.Errorf("listed %d orphans of unique identities, want 9", n)
+	}
+	got := testRows(t, db, tables)
+	want := []string{"enrollments 5", "enrollments 6", "identities i1", "identities i2", "profiles u1", "uidentities u1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("rows after deleting orphaned unique identities = %v, want %v", got, want)
+	}
+	err = cleanupOrphans(ctx, db, orphanKinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = testRows(t, db, tables)
+	want = []string{"enrollments 5", "identities i1", "profiles u1", "uidentities u1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("rows after deleting all orphans = %v, want %v", got, want)
+	}
+	got = testRows(t, db, "select table_name, row_key from cleanup_audit where operation = 'delete'")
+	if len(got) != 11 {
+		t.Errorf("audit records of deleted orphans = %v, want 11", got)
+	}
+}